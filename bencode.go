@@ -0,0 +1,167 @@
+package kademlia
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Deepest nesting of lists and dictionaries accepted when decoding
+const MaxBencodeDepth = 32
+
+var errBencodeTruncated = errors.New("Truncated bencoded value")
+
+// Encodes strings, byte slices, integers, lists and dictionaries with string
+// keys, the types returned by bdecode
+func bencode(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := bencodeTo(&buffer, v)
+	return buffer.Bytes(), err
+}
+
+func bencodeTo(buffer *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		buffer.WriteString(strconv.Itoa(len(v)))
+		buffer.WriteByte(':')
+		buffer.WriteString(v)
+	case []byte:
+		return bencodeTo(buffer, string(v))
+	case int:
+		return bencodeTo(buffer, int64(v))
+	case int64:
+		buffer.WriteByte('i')
+		buffer.WriteString(strconv.FormatInt(v, 10))
+		buffer.WriteByte('e')
+	case []interface{}:
+		buffer.WriteByte('l')
+		for _, item := range v {
+			if err := bencodeTo(buffer, item); err != nil {
+				return err
+			}
+		}
+		buffer.WriteByte('e')
+	case map[string]interface{}:
+		// Keys are sorted as raw strings
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buffer.WriteByte('d')
+		for _, key := range keys {
+			bencodeTo(buffer, key)
+			if err := bencodeTo(buffer, v[key]); err != nil {
+				return err
+			}
+		}
+		buffer.WriteByte('e')
+	default:
+		return fmt.Errorf("Cannot bencode %T", v)
+	}
+
+	return nil
+}
+
+// Decodes a single value spanning all of data.  Strings decode to string,
+// integers to int64, lists to []interface{} and dictionaries to
+// map[string]interface{}.
+func bdecode(data []byte) (interface{}, error) {
+	v, rest, err := bdecodeValue(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("Trailing data after bencoded value")
+	}
+
+	return v, nil
+}
+
+func bdecodeValue(data []byte, depth int) (interface{}, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, errBencodeTruncated
+	}
+	if depth > MaxBencodeDepth {
+		return nil, nil, errors.New("Bencoded value nested too deeply")
+	}
+
+	switch {
+	case data[0] == 'i':
+		end := bytes.IndexByte(data, 'e')
+		if end < 0 {
+			return nil, nil, errBencodeTruncated
+		}
+		digits := string(data[1:end])
+		if digits == "-0" || len(digits) > 1 && (digits[0] == '0' ||
+			digits[0] == '-' && digits[1] == '0') {
+			return nil, nil, fmt.Errorf("Invalid bencoded integer %q", digits)
+		}
+		n, err := strconv.ParseInt(digits, 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid bencoded integer %q", digits)
+		}
+		return n, data[end+1:], nil
+
+	case data[0] >= '0' && data[0] <= '9':
+		colon := bytes.IndexByte(data, ':')
+		if colon < 0 {
+			return nil, nil, errBencodeTruncated
+		}
+		length, err := strconv.Atoi(string(data[:colon]))
+		if err != nil || length < 0 || colon > 1 && data[0] == '0' {
+			return nil, nil, fmt.Errorf("Invalid bencoded string length %q", data[:colon])
+		}
+		data = data[colon+1:]
+		if len(data) < length {
+			return nil, nil, errBencodeTruncated
+		}
+		return string(data[:length]), data[length:], nil
+
+	case data[0] == 'l':
+		list := []interface{}{}
+		data = data[1:]
+		for len(data) > 0 && data[0] != 'e' {
+			item, rest, err := bdecodeValue(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			list = append(list, item)
+			data = rest
+		}
+		if len(data) == 0 {
+			return nil, nil, errBencodeTruncated
+		}
+		return list, data[1:], nil
+
+	case data[0] == 'd':
+		dict := make(map[string]interface{})
+		data = data[1:]
+		for len(data) > 0 && data[0] != 'e' {
+			key, rest, err := bdecodeValue(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, nil, errors.New("Bencoded dictionary key is not a string")
+			}
+
+			value, rest, err := bdecodeValue(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			dict[name] = value
+			data = rest
+		}
+		if len(data) == 0 {
+			return nil, nil, errBencodeTruncated
+		}
+		return dict, data[1:], nil
+	}
+
+	return nil, nil, fmt.Errorf("Invalid bencoded value starting with %q", data[0])
+}
@@ -0,0 +1,74 @@
+package kademlia
+
+import (
+	"reflect"
+	"testing"
+)
+
+var bencodeTests = []struct {
+	value   interface{}
+	encoded string
+}{
+	{"spam", "4:spam"},
+	{"", "0:"},
+	{int64(42), "i42e"},
+	{int64(-3), "i-3e"},
+	{int64(0), "i0e"},
+	{[]interface{}{"spam", int64(42)}, "l4:spami42ee"},
+	{map[string]interface{}{"cow": "moo", "spam": "eggs"}, "d3:cow3:moo4:spam4:eggse"},
+	// Example ping query from BEP 5
+	{
+		map[string]interface{}{
+			"t": "aa",
+			"y": "q",
+			"q": "ping",
+			"a": map[string]interface{}{"id": "abcdefghij0123456789"},
+		},
+		"d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe",
+	},
+}
+
+func TestBencode(t *testing.T) {
+	for _, tt := range bencodeTests {
+		encoded, err := bencode(tt.value)
+		if err != nil || string(encoded) != tt.encoded {
+			t.Errorf("bencode(%v) = %q, %v, expected %q", tt.value, encoded, err, tt.encoded)
+		}
+
+		decoded, err := bdecode([]byte(tt.encoded))
+		if err != nil || !reflect.DeepEqual(decoded, tt.value) {
+			t.Errorf("bdecode(%q) = %v, %v, expected %v", tt.encoded, decoded, err, tt.value)
+		}
+	}
+}
+
+var invalidBencode = []string{
+	"",
+	"i42",
+	"i-0e",
+	"i03e",
+	"ie",
+	"5:spam",
+	"03:abc",
+	"l4:spam",
+	"d3:cowe",
+	"di1e3:mooe",
+	"4:spamextra",
+	"x",
+}
+
+func TestBdecodeRejectsInvalid(t *testing.T) {
+	for _, data := range invalidBencode {
+		if _, err := bdecode([]byte(data)); err == nil {
+			t.Errorf("bdecode(%q) should fail", data)
+		}
+	}
+
+	nested := ""
+	for i := 0; i <= MaxBencodeDepth+1; i++ {
+		nested = "l" + nested + "e"
+	}
+	if _, err := bdecode([]byte(nested)); err == nil {
+		t.Error("Deeply nested values should be rejected")
+	}
+}
@@ -1,20 +1,124 @@
 package kademlia
 
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	JoinAttempts   = 3
+	JoinRetryDelay = 250 * time.Millisecond
+)
+
 func (k *Kademlia) Bootstrap(target, self Contact) ([]Contact, error) {
-	client, err := dialContact(target)
+	req := k.NewFindNodeRequest(self.ID)
+	res := FindNodeResponse{}
+
+	err := k.call(target, "KademliaCore.FindNodeRPC", &req, &res)
 	if err != nil {
 		return nil, err
 	}
 
-	req := k.NewFindNodeRequest(self.ID)
-	res := FindNodeResponse{}
+	return res.Contacts, nil
+}
 
-	err = client.Call("KademliaCore.FindNodeRPC", &req, &res)
+// Joins the network through any of the seeds, or those found under
+// SeedDomain: bootstraps from each reachable seed, looks up our own ID and
+// refreshes every bucket farther away than our closest neighbor
+func (k *Kademlia) Join(ctx context.Context, seeds ...Contact) error {
+	self := k.routes.Self()
+
+	if len(seeds) == 0 && k.SeedDomain != "" {
+		resolved, err := ResolveSeeds(ctx, k.SeedResolver, k.SeedDomain)
+		if err != nil {
+			return err
+		}
+		seeds = resolved
+	}
+
+	found := Contacts{}
+	reached := 0
+	for _, seed := range seeds {
+		contacts, err := k.bootstrapWithRetry(ctx, seed, self)
+		if err == nil {
+			found = append(found, contacts...)
+			reached++
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+
+	if reached == 0 {
+		return errors.New("Unable to reach any seed")
+	}
+
+	// Everyone who answers the self lookup ends up in the routing table
+	neighbors, err := k.lookupContext(ctx, self.ID, found)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if neighbors.Len() == 0 {
+		return nil
 	}
 
-	k.routes.Update(res.Sender)
+	closest := neighbors[0].ID.PrefixLen(self.ID)
+	for i := 0; i < closest; i++ {
+		_, err = k.lookupContext(ctx, k.routes.randomIDInBucket(i), nil)
+		if err != nil {
+			return err
+		}
+	}
 
-	return res.Contacts, nil
+	return nil
+}
+
+func (k *Kademlia) bootstrapWithRetry(ctx context.Context, seed, self Contact) ([]Contact,
+	error) {
+	delay := JoinRetryDelay
+
+	for attempt := 1; ; attempt++ {
+		contacts, err := k.bootstrapSeed(seed, self)
+		if err == nil || attempt == JoinAttempts {
+			return contacts, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// Seeds given by address alone are pinged to learn their NodeID first
+func (k *Kademlia) bootstrapSeed(seed, self Contact) ([]Contact, error) {
+	if seed.ID == (NodeID{}) {
+		identified, err := k.ping(seed)
+		if err != nil {
+			return nil, err
+		}
+		seed = identified
+	}
+
+	return k.Bootstrap(seed, self)
+}
+
+// Iterative node lookup seeded with extra contacts on top of our own closest
+func (k *Kademlia) lookupContext(ctx context.Context, target NodeID,
+	extra Contacts) (Contacts, error) {
+	seeds := append(k.routes.FindClosest(target, BucketSize), extra...)
+
+	done := make(chan Contacts, 1)
+	go func() {
+		done <- newLookup(k.routes.self.ID, target, Delta, k.findNode).run(seeds, 1)
+	}()
+
+	select {
+	case contacts := <-done:
+		return contacts, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
@@ -0,0 +1,53 @@
+package kademlia
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRandomIDInBucket(t *testing.T) {
+	table := NewRoutingTable(NewContact(NewRandomNodeID(), ""))
+
+	for i := 0; i < IDBytesLength; i++ {
+		id := table.randomIDInBucket(i)
+		if id.PrefixLen(table.Self().ID) != i {
+			t.Errorf("ID for bucket %d shares %d bits with self", i, id.PrefixLen(table.Self().ID))
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	seed := newTestNode(t)
+	for i := 0; i < 10; i++ {
+		node := newTestNode(t)
+		if err := node.Join(context.Background(), seed.routes.Self()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dead := NewContact(NewRandomNodeID(), "127.0.0.1:1")
+	joiner := newTestNode(t)
+	if err := joiner.Join(context.Background(), dead, seed.routes.Self()); err != nil {
+		t.Fatal("Join should succeed as long as one seed is reachable:", err)
+	}
+
+	if known := len(joiner.routes.SeenContacts()); known < 10 {
+		t.Errorf("Self lookup should discover the network, only know %d contacts", known)
+	}
+}
+
+func TestJoinFailsWithoutSeeds(t *testing.T) {
+	joiner := newTestNode(t)
+	dead := NewContact(NewRandomNodeID(), "127.0.0.1:1")
+
+	if joiner.Join(context.Background(), dead) == nil {
+		t.Error("Join should fail when no seed is reachable")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := joiner.Join(ctx, dead); err != context.DeadlineExceeded {
+		t.Error("Join should give up once the context is done, got", err)
+	}
+}
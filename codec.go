@@ -0,0 +1,187 @@
+package kademlia
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"strings"
+)
+
+const (
+	// Opens connections, followed by the name of the codec proposed by the
+	// dialer.  The listener echoes the line to accept.  Connections without it
+	// speak plain gob.
+	CodecPreamble = "kademlia/1"
+	// Longest preamble line accepted
+	MaxPreambleLength = 64
+)
+
+// Codec encodes RPCs on a connection
+type Codec interface {
+	Name() string
+	NewClient(conn io.ReadWriteCloser) *rpc.Client
+	ServeConn(server *rpc.Server, conn io.ReadWriteCloser)
+}
+
+var (
+	// Go's native encoding, understood only by Go peers
+	GobCodec Codec = gobCodec{}
+	// JSON-RPC 1.0, handy for debugging by hand
+	JSONCodec Codec = jsonCodec{}
+	// Protocol buffers following kademlia.proto
+	ProtoCodec Codec = protoCodec{}
+)
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) NewClient(conn io.ReadWriteCloser) *rpc.Client {
+	return rpc.NewClient(conn)
+}
+
+func (gobCodec) ServeConn(server *rpc.Server, conn io.ReadWriteCloser) {
+	server.ServeConn(conn)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) NewClient(conn io.ReadWriteCloser) *rpc.Client {
+	return jsonrpc.NewClient(conn)
+}
+
+func (jsonCodec) ServeConn(server *rpc.Server, conn io.ReadWriteCloser) {
+	server.ServeCodec(jsonrpc.NewServerCodec(conn))
+}
+
+func (k *Kademlia) codec() Codec {
+	if k.Codec == nil {
+		return GobCodec
+	}
+	return k.Codec
+}
+
+func (k *Kademlia) acceptedCodec(name string) (Codec, bool) {
+	codecs := k.Codecs
+	if codecs == nil {
+		codecs = []Codec{GobCodec, JSONCodec, ProtoCodec}
+	}
+
+	for _, codec := range codecs {
+		if codec.Name() == name {
+			return codec, true
+		}
+	}
+
+	return nil, false
+}
+
+func preamble(codec string) string {
+	return CodecPreamble + " " + codec + "\n"
+}
+
+// Reads up to and including the next newline without buffering past it
+func readPreamble(r io.Reader) (string, error) {
+	line := []byte{}
+	b := make([]byte, 1)
+	for len(line) < MaxPreambleLength {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+
+	return "", errors.New("Codec preamble too long")
+}
+
+// Proposes codec to the listener on conn.  The request may be written right
+// away, the listener's answer is checked before the first response is read.
+// Gob is spoken without a preamble, as listeners predating codec negotiation
+// expect.
+func proposeCodec(conn net.Conn, codec Codec) (net.Conn, error) {
+	if codec.Name() == GobCodec.Name() {
+		return conn, nil
+	}
+
+	if _, err := io.WriteString(conn, preamble(codec.Name())); err != nil {
+		return nil, err
+	}
+
+	return &proposedConn{Conn: conn, codec: codec.Name()}, nil
+}
+
+type proposedConn struct {
+	net.Conn
+	codec    string
+	accepted bool
+}
+
+func (c *proposedConn) Read(b []byte) (int, error) {
+	if !c.accepted {
+		line, err := readPreamble(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		if line != strings.TrimSuffix(preamble(c.codec), "\n") {
+			return 0, fmt.Errorf("Peer refused codec %s: %q", c.codec, line)
+		}
+		c.accepted = true
+	}
+
+	return c.Conn.Read(b)
+}
+
+// Reads the dialer's proposal and accepts it when the codec is known
+// Dialers predating codec negotiation speak plain gob without a preamble,
+// so the start of the connection is peeked at before reading one.  Returns
+// the connection to serve, which replays whatever was peeked.
+func (k *Kademlia) acceptCodec(conn net.Conn) (Codec, net.Conn, error) {
+	prefix := make([]byte, len(CodecPreamble)+1)
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		return nil, nil, err
+	}
+
+	if string(prefix) != CodecPreamble+" " {
+		codec, ok := k.acceptedCodec(GobCodec.Name())
+		if !ok {
+			return nil, nil, errors.New("Missing codec preamble")
+		}
+		return codec, &peekedConn{conn, io.MultiReader(bytes.NewReader(prefix), conn)}, nil
+	}
+
+	name, err := readPreamble(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	codec, ok := k.acceptedCodec(name)
+	if !ok {
+		io.WriteString(conn, preamble("-"))
+		return nil, nil, fmt.Errorf("Unsupported codec %s", name)
+	}
+
+	_, err = io.WriteString(conn, preamble(name))
+	return codec, conn, err
+}
+
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,213 @@
+package kademlia
+
+import (
+	"bytes"
+	"net"
+	"net/rpc"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testHeader = RPCHeader{
+	Sender:       NewContact(NewRandomNodeID(), "127.0.0.1:6000"),
+	NetworkID:    "test",
+	PublicKey:    []byte{1, 2, 3},
+	Nonce:        NewRandomNodeID(),
+	Version:      ProtocolVersion,
+	MinVersion:   MinProtocolVersion,
+	Capabilities: DefaultCapabilities,
+}
+
+var protoTests = []protoMessage{
+	&PingRequest{testHeader},
+	&PingResponse{testHeader},
+	&FindNodeRequest{testHeader, NewRandomNodeID()},
+	&FindNodeResponse{testHeader, Contacts{
+		NewContact(NewRandomNodeID(), "10.0.0.1:6000"),
+		NewContact(NewRandomNodeID(), "[::1]:6000"),
+		{ID: NewRandomNodeID(), Address: "10.0.0.3:6000",
+			Alternates: [MaxAddresses - 1]string{"[2001:db8::3]:6000", "node.example.com:6000"}},
+	}},
+	&FindValueRequest{testHeader, NewRandomNodeID(), NewRandomNodeID()},
+	&FindValueResponse{
+		RPCHeader: testHeader,
+		Value:     "value",
+		Record: &Record{
+			Kind:      MutableRecord,
+			Value:     []byte("value"),
+			PublicKey: []byte{4, 5},
+			Salt:      []byte("salt"),
+			Seq:       7,
+			Signature: []byte{6},
+		},
+		Providers:     Contacts{NewContact(NewRandomNodeID(), "10.0.0.2:6000")},
+		MoreProviders: true,
+	},
+	&StoreRequest{testHeader, NewRandomNodeID(), NewImmutableRecord([]byte("v"))},
+	&StoreResponse{testHeader},
+	&AddProviderRequest{testHeader, NewRandomNodeID(), time.Hour},
+	&AddProviderResponse{testHeader},
+}
+
+func TestProtoRoundTrip(t *testing.T) {
+	for _, message := range protoTests {
+		// A fresh target each run, so repeated runs decode into nothing stale
+		decoded := reflect.New(reflect.TypeOf(message).Elem()).Interface().(protoMessage)
+		if err := decoded.unmarshalProto(marshalProto(message)); err != nil {
+			t.Errorf("Decoding %T failed: %s", message, err)
+			continue
+		}
+		if !reflect.DeepEqual(message, decoded) {
+			t.Errorf("%T did not survive encoding:\n%+v\n%+v", message, message, decoded)
+		}
+	}
+}
+
+func TestProtoWireFormat(t *testing.T) {
+	contact := Contact{Address: "a"}
+	if data := marshalProto(&contact); !bytes.Equal(data, []byte{0x12, 0x01, 'a'}) {
+		t.Errorf("Unexpected encoding % x", data)
+	}
+
+	// Fields unknown to this schema version are skipped
+	data := []byte{
+		0x08, 0x96, 0x01, // field 1, varint 150
+		0x12, 0x01, 'a', // field 2, "a"
+		0x3d, 1, 2, 3, 4, // field 7, fixed32
+		0x29, 1, 2, 3, 4, 5, 6, 7, 8, // field 5, fixed64
+	}
+	decoded := Contact{}
+	if err := decoded.unmarshalProto(data[3:]); err != nil || decoded != contact {
+		t.Errorf("Unknown fields should be skipped, got %+v, %v", decoded, err)
+	}
+
+	// A varint where the ID's bytes belong is rejected
+	if err := decoded.unmarshalProto(data); err == nil {
+		t.Error("Mismatched wire type should be rejected")
+	}
+
+	if err := decoded.unmarshalProto([]byte{0x12, 0x05, 'a'}); err == nil {
+		t.Error("Truncated message should be rejected")
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	for _, codec := range []Codec{GobCodec, JSONCodec, ProtoCodec} {
+		server := newTestNode(t)
+		client := newTestNode(t)
+		client.Codec = codec
+
+		if err := client.Ping(server.routes.Self()); err != nil {
+			t.Errorf("%s: ping failed: %s", codec.Name(), err)
+			continue
+		}
+
+		contacts, err := client.findNode(server.routes.Self(), NewRandomNodeID())
+		if err != nil || contacts.Len() != 1 || contacts[0].ID != client.routes.Self().ID {
+			t.Errorf("%s: find node returned %v, %v", codec.Name(), contacts, err)
+		}
+
+		record := NewImmutableRecord([]byte(codec.Name()))
+		key := ImmutableKey(record.Value)
+		if err := client.Store(server.routes.Self(), key, record); err != nil {
+			t.Errorf("%s: store failed: %s", codec.Name(), err)
+		}
+
+		found, _, err := client.findRecord(server.routes.Self(), key)
+		if err != nil || found == nil || !bytes.Equal(found.Value, record.Value) {
+			t.Errorf("%s: find value returned %v, %v", codec.Name(), found, err)
+		}
+
+		// Errors from handlers reach the caller
+		if client.Store(server.routes.Self(), NewRandomNodeID(), record) == nil {
+			t.Errorf("%s: storing under the wrong key should fail", codec.Name())
+		}
+	}
+}
+
+func TestUnsupportedCodecRefused(t *testing.T) {
+	server := newTestNode(t)
+	server.Codecs = []Codec{GobCodec}
+	client := newTestNode(t)
+	client.Codec = JSONCodec
+
+	if client.Ping(server.routes.Self()) == nil {
+		t.Error("Server should refuse codecs it does not accept")
+	}
+
+	client.Codec = GobCodec
+	if err := client.Ping(server.routes.Self()); err != nil {
+		t.Error("Accepted codec should work:", err)
+	}
+}
+
+// RPC types as declared before codec negotiation and protocol versions
+type legacyContact struct {
+	ID      NodeID
+	Address string
+}
+
+type legacyHeader struct {
+	Sender    legacyContact
+	NetworkID string
+}
+
+// Embedded as RPCHeader at the time
+type legacyPing struct {
+	RPCHeader legacyHeader
+}
+
+func TestLegacyGobClient(t *testing.T) {
+	server := newTestNode(t)
+	sender := legacyContact{NewRandomNodeID(), "127.0.0.1:1"}
+
+	client, err := rpc.Dial("tcp", server.routes.Self().Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	res := legacyPing{}
+	err = client.Call("KademliaCore.PingRPC", &legacyPing{legacyHeader{sender, server.NetworkID}}, &res)
+	if err != nil {
+		t.Fatal("Plain gob ping failed:", err)
+	}
+	if res.RPCHeader.Sender.ID != server.routes.Self().ID {
+		t.Errorf("Expected pong from %s, got %s", server.routes.Self().ID, res.RPCHeader.Sender.ID)
+	}
+	if !server.routes.Contains(sender.ID) {
+		t.Error("Legacy sender should be added to the routing table")
+	}
+	if !server.routes.Capable(sender.ID, DefaultCapabilities) {
+		t.Error("Legacy sender should be assumed to offer the default capabilities")
+	}
+}
+
+// Serves plain gob without reading a preamble, as before codec negotiation
+func TestLegacyGobServer(t *testing.T) {
+	server := newTestNode(t)
+	client := newTestNode(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			legacy := rpc.NewServer()
+			legacy.Register(&KademliaCore{kad: server})
+			go legacy.ServeConn(conn)
+		}
+	}()
+
+	if err := client.Ping(NewContact(server.routes.Self().ID, l.Addr().String())); err != nil {
+		t.Error("Gob ping of a server without codec negotiation failed:", err)
+	}
+}
@@ -1,5 +1,19 @@
 package kademlia
 
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Most addresses a contact carries, tried in order when dialing
+	MaxAddresses = 4
+)
+
 /*
  * Contact
  */
@@ -7,6 +21,9 @@ package kademlia
 type Contact struct {
 	ID      NodeID
 	Address string
+	// Further addresses tried after Address.  A fixed size array keeps
+	// contacts comparable, unused slots are empty.
+	Alternates [MaxAddresses - 1]string
 }
 
 func NewContact(node NodeID, address string) Contact {
@@ -16,6 +33,134 @@ func NewContact(node NodeID, address string) Contact {
 	}
 }
 
+// Contact reachable at each of addresses, in order of preference
+func NewMultiContact(node NodeID, addresses ...string) (Contact, error) {
+	if len(addresses) == 0 {
+		return Contact{}, errors.New("Contact requires an address")
+	}
+	if len(addresses) > MaxAddresses {
+		return Contact{}, fmt.Errorf("Contact has %d addresses, at most %d are allowed",
+			len(addresses), MaxAddresses)
+	}
+
+	contact := NewContact(node, addresses[0])
+	copy(contact.Alternates[:], addresses[1:])
+
+	return contact, contact.Validate()
+}
+
+// Address followed by the alternates in use
+func (c Contact) Addresses() []string {
+	addresses := []string{c.Address}
+	for _, address := range c.Alternates {
+		if address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return addresses
+}
+
+// Clients carry no address and accept no connections
+func (c Contact) isClient() bool {
+	return c == NewContact(c.ID, "")
+}
+
+// The contact with address moved to the front of its addresses
+func (c Contact) preferring(address string) Contact {
+	addresses := []string{address}
+	for _, other := range c.Addresses() {
+		if other != address {
+			addresses = append(addresses, other)
+		}
+	}
+
+	preferred := NewContact(c.ID, addresses[0])
+	copy(preferred.Alternates[:], addresses[1:])
+
+	return preferred
+}
+
+// Every address must be valid and appear once, alternates filled in order
+func (c Contact) Validate() error {
+	seen := make(map[string]struct{})
+	addresses := append([]string{c.Address}, c.Alternates[:]...)
+	for i, address := range addresses {
+		if address == "" {
+			for _, rest := range addresses[i:] {
+				if rest != "" {
+					return errors.New("Contact addresses have a gap")
+				}
+			}
+			break
+		}
+
+		err := ValidateAddress(address)
+		if err != nil {
+			return err
+		}
+		if _, ok := seen[address]; ok {
+			return fmt.Errorf("Contact lists address %s twice", address)
+		}
+		seen[address] = struct{}{}
+	}
+
+	if len(seen) == 0 {
+		return errors.New("Contact requires an address")
+	}
+
+	return nil
+}
+
+// Addresses are an IPv4 address, bracketed IPv6 address or hostname and a
+// port.  Unspecified addresses such as 0.0.0.0 reach no one in particular and
+// are refused.
+func ValidateAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || number == 0 {
+		return fmt.Errorf("Invalid port in address %s", address)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsUnspecified() {
+			return fmt.Errorf("Address %s is unspecified", address)
+		}
+		return nil
+	}
+
+	if !validHostname(host) {
+		return fmt.Errorf("Invalid host in address %s", address)
+	}
+
+	return nil
+}
+
+func validHostname(host string) bool {
+	if len(host) == 0 || len(host) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 ||
+			label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+				c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
 /*
  * Contacts
  */
@@ -37,3 +182,25 @@ func (h *Contacts) Pop() interface{} {
 	*h = oldHeap[0 : oldLength-1]
 	return element
 }
+
+func (h *Contacts) remove(id NodeID) {
+	for i, contact := range *h {
+		if contact.ID == id {
+			*h = append((*h)[:i], (*h)[i+1:]...)
+			return
+		}
+	}
+}
+
+func (h Contacts) SortByDistance(target NodeID) {
+	sort.Sort(byDistance{h, target})
+}
+
+type byDistance struct {
+	Contacts
+	target NodeID
+}
+
+func (h byDistance) Less(i, j int) bool {
+	return h.Contacts[i].ID.Xor(h.target).Less(h.Contacts[j].ID.Xor(h.target))
+}
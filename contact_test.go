@@ -124,3 +124,69 @@ func TestContactsPop(t *testing.T) {
 		t.Error("Contact was not copied correctly during Pop")
 	}
 }
+
+var addressTests = []struct {
+	address string
+	valid   bool
+}{
+	{"127.0.0.1:6000", true},
+	{"[2001:db8::1]:6000", true},
+	{"node-1.example.com:6000", true},
+	{"127.0.0.1", false},
+	{"2001:db8::1:6000", false},
+	{"127.0.0.1:0", false},
+	{"127.0.0.1:65536", false},
+	{"0.0.0.0:6000", false},
+	{"[::]:6000", false},
+	{"-bad.example.com:6000", false},
+	{":6000", false},
+}
+
+func TestValidateAddress(t *testing.T) {
+	for _, tt := range addressTests {
+		err := kademlia.ValidateAddress(tt.address)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid %v, got %v", tt.address, tt.valid, err)
+		}
+	}
+}
+
+func TestNewMultiContact(t *testing.T) {
+	id := kademlia.NewRandomNodeID()
+	addresses := []string{"127.0.0.1:6000", "[::1]:6000"}
+
+	contact, err := kademlia.NewMultiContact(id, addresses...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contact.Address != addresses[0] {
+		t.Errorf("Expected address %s, got %s", addresses[0], contact.Address)
+	}
+	if fmt.Sprint(contact.Addresses()) != fmt.Sprint(addresses) {
+		t.Errorf("Expected addresses %v, got %v", addresses, contact.Addresses())
+	}
+
+	// Contacts remain comparable
+	same, _ := kademlia.NewMultiContact(id, addresses...)
+	if contact != same || contact == kademlia.NewContact(id, addresses[0]) {
+		t.Error("Contacts should compare equal exactly when their addresses match")
+	}
+
+	if _, err := kademlia.NewMultiContact(id); err == nil {
+		t.Error("Contact without addresses should be rejected")
+	}
+	if _, err := kademlia.NewMultiContact(id, addresses[0], addresses[0]); err == nil {
+		t.Error("Duplicate addresses should be rejected")
+	}
+	if _, err := kademlia.NewMultiContact(id, addresses[0], "[::1]"); err == nil {
+		t.Error("Invalid addresses should be rejected")
+	}
+
+	tooMany := []string{}
+	for i := 0; i <= kademlia.MaxAddresses; i++ {
+		tooMany = append(tooMany, fmt.Sprintf("127.0.0.1:%d", 6000+i))
+	}
+	if _, err := kademlia.NewMultiContact(id, tooMany...); err == nil {
+		t.Errorf("More than %d addresses should be rejected", kademlia.MaxAddresses)
+	}
+}
@@ -0,0 +1,199 @@
+package kademlia
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DiscoveryInterval  = 30 * time.Second
+	DiscoveryRateLimit = 10
+	LoopbackPorts      = 16
+	MaxAnnouncement    = 1024
+)
+
+var DefaultDiscoveryGroup = &net.UDPAddr{IP: net.IPv4(239, 192, 72, 6), Port: 6772}
+
+type DiscoveryConfig struct {
+	// Multicast group to announce on, DefaultDiscoveryGroup if nil
+	Group     *net.UDPAddr
+	Interface *net.Interface
+	// Time between our own announcements
+	Interval time.Duration
+	// Announcements handled per second, the rest are dropped
+	RateLimit int
+	// Replaces multicast with unicast to LoopbackPorts consecutive ports on
+	// 127.0.0.1 starting at the group's port, for hosts without multicast
+	Loopback bool
+}
+
+// Announcements carry the same header as RPCs and are checked the same way
+type Announcement struct {
+	RPCHeader
+}
+
+/*
+ * Discovery
+ * Finds peers on the local network without seeds
+ */
+
+type Discovery struct {
+	kad     *Kademlia
+	config  DiscoveryConfig
+	conn    *net.UDPConn
+	targets []*net.UDPAddr
+	limiter *rateLimiter
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (k *Kademlia) StartDiscovery(config DiscoveryConfig) (*Discovery, error) {
+	if config.Group == nil {
+		config.Group = DefaultDiscoveryGroup
+	}
+	if config.Interval <= 0 {
+		config.Interval = DiscoveryInterval
+	}
+	if config.RateLimit <= 0 {
+		config.RateLimit = DiscoveryRateLimit
+	}
+
+	d := &Discovery{
+		kad:     k,
+		config:  config,
+		limiter: newRateLimiter(config.RateLimit),
+		done:    make(chan struct{}),
+	}
+
+	var err error
+	if config.Loopback {
+		err = d.listenLoopback()
+	} else {
+		d.conn, err = net.ListenMulticastUDP("udp", config.Interface, config.Group)
+		d.targets = []*net.UDPAddr{config.Group}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	go d.announce()
+	go d.receive()
+
+	return d, nil
+}
+
+func (d *Discovery) Close() error {
+	d.once.Do(func() {
+		close(d.done)
+	})
+	return d.conn.Close()
+}
+
+// Binds the first free port in the loopback range and announces to the rest
+func (d *Discovery) listenLoopback() error {
+	base := d.config.Group.Port
+
+	for port := base; port < base+LoopbackPorts; port++ {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+		if err != nil {
+			continue
+		}
+
+		d.conn = conn
+		for target := base; target < base+LoopbackPorts; target++ {
+			if target != port {
+				d.targets = append(d.targets, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: target})
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("No free loopback discovery port in %d-%d", base, base+LoopbackPorts-1)
+}
+
+func (d *Discovery) announce() {
+	ticker := time.NewTicker(d.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		var buffer bytes.Buffer
+		err := gob.NewEncoder(&buffer).Encode(Announcement{d.kad.newRPCHeader()})
+		if err == nil {
+			for _, target := range d.targets {
+				d.conn.WriteToUDP(buffer.Bytes(), target)
+			}
+		}
+
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Discovery) receive() {
+	buffer := make([]byte, MaxAnnouncement)
+
+	for {
+		n, _, err := d.conn.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			continue
+		}
+
+		if !d.limiter.allow() {
+			continue
+		}
+
+		announcement := Announcement{}
+		err = gob.NewDecoder(bytes.NewReader(buffer[:n])).Decode(&announcement)
+		if err != nil || announcement.Sender.ID == d.kad.routes.self.ID {
+			continue
+		}
+
+		// Checks the network and puzzles before updating the routing table
+		d.kad.HandleRPC(announcement.RPCHeader, &RPCHeader{})
+	}
+}
+
+/*
+ * rateLimiter
+ * Token bucket refilled at rate tokens per second
+ */
+
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+func (r *rateLimiter) allow() bool {
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.last = now
+
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+
+	return true
+}
@@ -0,0 +1,80 @@
+package kademlia
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLoopbackDiscovery(t *testing.T) {
+	config := DiscoveryConfig{
+		Group:    &net.UDPAddr{IP: DefaultDiscoveryGroup.IP, Port: 47310},
+		Interval: 20 * time.Millisecond,
+		Loopback: true,
+	}
+
+	nodes := []*Kademlia{newTestNode(t), newTestNode(t), newTestNode(t)}
+	for _, node := range nodes {
+		discovery, err := node.StartDiscovery(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer discovery.Close()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		discovered := true
+		for _, node := range nodes {
+			if len(node.routes.SeenContacts()) != len(nodes)-1 {
+				discovered = false
+			}
+		}
+		if discovered {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Error("Nodes should discover each other over loopback")
+}
+
+func TestDiscoveryIgnoresOtherNetworks(t *testing.T) {
+	config := DiscoveryConfig{
+		Group:    &net.UDPAddr{IP: DefaultDiscoveryGroup.IP, Port: 47330},
+		Interval: 20 * time.Millisecond,
+		Loopback: true,
+	}
+
+	node := newTestNode(t)
+	stranger := newTestNode(t)
+	stranger.NetworkID = "other"
+
+	for _, kad := range []*Kademlia{node, stranger} {
+		discovery, err := kad.StartDiscovery(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer discovery.Close()
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if len(node.routes.SeenContacts()) != 0 {
+		t.Error("Announcements from other networks should be ignored")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(5)
+
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if limiter.allow() {
+			allowed++
+		}
+	}
+
+	if allowed != 5 {
+		t.Errorf("Expected a burst of 5 to be allowed, got %d", allowed)
+	}
+}
@@ -0,0 +1,104 @@
+package kademlia
+
+import "net"
+
+// Contacts within these prefixes are treated as a single network
+const (
+	IPv4SubnetBits = 24
+	IPv6SubnetBits = 48
+)
+
+// Hostnames could resolve anywhere, so they all share a single subnet
+const HostnameSubnet = "hostname"
+
+// The /24 or /48 an address belongs to, or HostnameSubnet.  False for
+// addresses without a host.
+func subnetOf(address string) (string, bool) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		return "", false
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return HostnameSubnet, true
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(IPv4SubnetBits, 32)).String() + "/24", true
+	}
+
+	return ip.Mask(net.CIDRMask(IPv6SubnetBits, 128)).String() + "/48", true
+}
+
+func (rt *RoutingTable) limitedSubnet(contact Contact) (string, bool) {
+	if rt.config.MaxSubnetPerBucket <= 0 && rt.config.MaxSubnetPerTable <= 0 {
+		return "", false
+	}
+
+	return subnetOf(contact.Address)
+}
+
+func (rt *RoutingTable) atSubnetLimit(id NodeID, subnet string) bool {
+	bucket := rt.kbuckets[rt.bucketIndex(id)]
+	if max := rt.config.MaxSubnetPerBucket; max > 0 &&
+		len(bucket.subnetContacts(subnet)) >= max {
+		return true
+	}
+
+	max := rt.config.MaxSubnetPerTable
+	return max > 0 && len(rt.subnetContacts(subnet)) >= max
+}
+
+// Evicts the least recently seen contacts from subnet while it exceeds a
+// limit, never the newcomer id itself
+func (rt *RoutingTable) enforceSubnetLimits(id NodeID, subnet string) {
+	if max := rt.config.MaxSubnetPerBucket; max > 0 {
+		peers := rt.kbuckets[rt.bucketIndex(id)].subnetContacts(subnet)
+		for i := 0; len(peers)-i > max; i++ {
+			if peers[i].ID != id {
+				rt.evict(peers[i].ID)
+			}
+		}
+	}
+
+	if max := rt.config.MaxSubnetPerTable; max > 0 {
+		peers := rt.subnetContacts(subnet)
+		for len(peers) > max {
+			oldest := -1
+			for i, peer := range peers {
+				if peer.ID == id {
+					continue
+				}
+				if oldest < 0 || rt.metrics[peer.ID].LastSeen.Before(rt.metrics[peers[oldest].ID].LastSeen) {
+					oldest = i
+				}
+			}
+
+			rt.evict(peers[oldest].ID)
+			peers = append(peers[:oldest], peers[oldest+1:]...)
+		}
+	}
+}
+
+func (rt *RoutingTable) subnetContacts(subnet string) Contacts {
+	contacts := Contacts{}
+	for _, bucket := range rt.kbuckets {
+		contacts = append(contacts, bucket.subnetContacts(subnet)...)
+	}
+
+	return contacts
+}
+
+// Contacts from subnet, least recently seen first
+func (kb *KBucket) subnetContacts(subnet string) Contacts {
+	contacts := Contacts{}
+	for el := kb.Front(); el != nil; el = el.Next() {
+		contact := el.Value.(Contact)
+		if s, ok := subnetOf(contact.Address); ok && s == subnet {
+			contacts = append(contacts, contact)
+		}
+	}
+
+	return contacts
+}
@@ -0,0 +1,108 @@
+package kademlia
+
+import (
+	"fmt"
+	"testing"
+)
+
+var subnetTests = []struct {
+	address string
+	subnet  string
+	ok      bool
+}{
+	{"10.1.2.3:6000", "10.1.2.0/24", true},
+	{"10.1.2.200:7000", "10.1.2.0/24", true},
+	{"[::ffff:10.1.2.3]:6000", "10.1.2.0/24", true},
+	{"[2001:db8:1:2::1]:6000", "2001:db8:1::/48", true},
+	{"[2001:db8:1:ffff::1]:6000", "2001:db8:1::/48", true},
+	{"example.com:6000", HostnameSubnet, true},
+	{"node.example.org:7000", HostnameSubnet, true},
+	{":6000", "", false},
+	{"", "", false},
+}
+
+func TestSubnetOf(t *testing.T) {
+	for _, tt := range subnetTests {
+		subnet, ok := subnetOf(tt.address)
+		if subnet != tt.subnet || ok != tt.ok {
+			t.Errorf("subnetOf(%q) = %q, %v, expected %q, %v",
+				tt.address, subnet, ok, tt.subnet, tt.ok)
+		}
+	}
+}
+
+func subnetContact(subnet, host int) Contact {
+	return NewContact(NewRandomNodeID(), fmt.Sprintf("10.0.%d.%d:6000", subnet, host))
+}
+
+func TestBucketSubnetLimit(t *testing.T) {
+	table := NewRoutingTableWithConfig(selfContact, RoutingConfig{MaxSubnetPerBucket: 2})
+
+	first, second, third := subnetContact(1, 1), subnetContact(1, 2), subnetContact(1, 3)
+	other := subnetContact(2, 1)
+	for _, contact := range []Contact{first, second, other, third} {
+		table.Update(contact)
+	}
+
+	if table.contains(first.ID) {
+		t.Error("Least recently seen contact from the subnet should be replaced")
+	}
+	for _, contact := range []Contact{second, third, other} {
+		if !table.contains(contact.ID) {
+			t.Errorf("Contact %v should be kept", contact.Address)
+		}
+	}
+
+	// Refreshing a known contact never counts against the limit
+	table.Update(second)
+	if !table.contains(second.ID) || !table.contains(third.ID) {
+		t.Error("Known contacts should survive a refresh")
+	}
+}
+
+func TestTableSubnetLimit(t *testing.T) {
+	table := NewRoutingTableWithConfig(selfContact, RoutingConfig{MaxSubnetPerTable: 3})
+
+	for i := 0; i < 10; i++ {
+		table.Update(subnetContact(1, i))
+	}
+	table.Update(subnetContact(2, 1))
+
+	if n := len(table.subnetContacts("10.0.1.0/24")); n != 3 {
+		t.Errorf("Expected 3 contacts from the subnet, got %d", n)
+	}
+	if n := len(table.SeenContacts()); n != 4 {
+		t.Errorf("Expected 4 contacts in the table, got %d", n)
+	}
+}
+
+func TestPreferLongLived(t *testing.T) {
+	table := NewRoutingTableWithConfig(selfContact, RoutingConfig{
+		MaxSubnetPerBucket: 2,
+		PreferLongLived:    true,
+	})
+
+	first, second, third := subnetContact(1, 1), subnetContact(1, 2), subnetContact(1, 3)
+	for _, contact := range []Contact{first, second, third} {
+		table.Update(contact)
+	}
+
+	if !table.contains(first.ID) || !table.contains(second.ID) {
+		t.Error("Long-lived contacts should be kept")
+	}
+	if table.contains(third.ID) {
+		t.Error("Newcomer should be refused once the subnet is at its limit")
+	}
+}
+
+func TestSubnetLimitsShareHostnames(t *testing.T) {
+	table := NewRoutingTableWithConfig(selfContact, RoutingConfig{MaxSubnetPerBucket: 1})
+
+	for i := 0; i < 5; i++ {
+		table.Update(NewContact(NewRandomNodeID(), fmt.Sprintf("node%d.example.com:6000", i)))
+	}
+
+	if n := len(table.SeenContacts()); n != 1 {
+		t.Errorf("Hostnames should share one subnet limit, got %d contacts", n)
+	}
+}
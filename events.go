@@ -0,0 +1,103 @@
+package kademlia
+
+import "sync/atomic"
+
+// Events buffered per subscription when no size is given
+const EventBuffer = 64
+
+type EventKind int
+
+const (
+	ContactAdded EventKind = iota
+	ContactRefreshed
+	// Removed with nothing to take its place
+	ContactEvicted
+	// Removed and succeeded by Replacement
+	ContactReplaced
+	// The bucket at Prefix and Depth split in two
+	BucketSplit
+)
+
+func (kind EventKind) String() string {
+	switch kind {
+	case ContactAdded:
+		return "added"
+	case ContactRefreshed:
+		return "refreshed"
+	case ContactEvicted:
+		return "evicted"
+	case ContactReplaced:
+		return "replaced"
+	case BucketSplit:
+		return "bucket split"
+	}
+
+	return "unknown"
+}
+
+type Event struct {
+	Kind        EventKind
+	Contact     Contact
+	Replacement Contact
+	Prefix      NodeID
+	Depth       int
+}
+
+/*
+ * Subscription
+ * Receives routing table events on C.  Events are never waited on, those
+ * arriving while C is full are dropped and counted.
+ */
+
+type Subscription struct {
+	C       <-chan Event
+	events  chan Event
+	dropped uint64
+	table   *RoutingTable
+}
+
+func (rt *RoutingTable) Subscribe(buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = EventBuffer
+	}
+
+	events := make(chan Event, buffer)
+	sub := &Subscription{C: events, events: events, table: rt}
+
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	if rt.subscriptions == nil {
+		rt.subscriptions = make(map[*Subscription]struct{})
+	}
+	rt.subscriptions[sub] = struct{}{}
+
+	return sub
+}
+
+// Number of events dropped because C was full
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// Stops delivery and closes C
+func (sub *Subscription) Close() {
+	rt := sub.table
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	if _, ok := rt.subscriptions[sub]; ok {
+		delete(rt.subscriptions, sub)
+		close(sub.events)
+	}
+}
+
+func (rt *RoutingTable) emit(event Event) {
+	for sub := range rt.subscriptions {
+		select {
+		case sub.events <- event:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
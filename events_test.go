@@ -0,0 +1,124 @@
+package kademlia
+
+import (
+	"testing"
+	"time"
+)
+
+func expectEvent(t *testing.T, sub *Subscription, kind EventKind, contact Contact) Event {
+	select {
+	case event := <-sub.C:
+		if event.Kind != kind || event.Contact != contact {
+			t.Errorf("Expected %v event for %v, got %v for %v",
+				kind, contact.Address, event.Kind, event.Contact.Address)
+		}
+		return event
+	default:
+		t.Fatalf("Expected %v event for %v, got none", kind, contact.Address)
+	}
+
+	return Event{}
+}
+
+func TestContactEvents(t *testing.T) {
+	table, contacts := fullFarBucket(RoutingConfig{StaleAfter: 1, RemoveAfter: 2})
+	sub := table.Subscribe(0)
+	defer sub.Close()
+
+	table.Update(contacts[0])
+	expectEvent(t, sub, ContactRefreshed, contacts[0])
+
+	// The full root bucket splits before caching the replacement
+	replacement := farContact(8000)
+	table.Update(replacement)
+	if event := <-sub.C; event.Kind != BucketSplit {
+		t.Errorf("Expected bucket split, got %v", event.Kind)
+	}
+
+	table.RecordFailure(contacts[1].ID)
+	event := expectEvent(t, sub, ContactReplaced, contacts[1])
+	if event.Replacement != replacement {
+		t.Error("Replaced event should name the promoted contact")
+	}
+
+	newcomer := farContact(8001)
+	table.RecordFailure(contacts[2].ID)
+	table.Update(newcomer)
+	event = expectEvent(t, sub, ContactReplaced, contacts[2])
+	if event.Replacement != newcomer {
+		t.Error("Replaced event should name the newcomer")
+	}
+
+	table.Remove(contacts[3].ID)
+	expectEvent(t, sub, ContactEvicted, contacts[3])
+}
+
+func TestSplitEvents(t *testing.T) {
+	table := NewRoutingTable(selfContact)
+	sub := table.Subscribe(BucketSize + 1)
+	defer sub.Close()
+
+	for i := 0; i < BucketSize; i++ {
+		contact := farContact(7000 + i)
+		table.Update(contact)
+		expectEvent(t, sub, ContactAdded, contact)
+	}
+
+	// The root bucket is full, so a contact near us splits it
+	near := NewRandomNodeID()
+	if near.bit(0) != selfID.bit(0) {
+		near.flipBit(0)
+	}
+	table.Update(NewContact(near, "127.0.0.1:9000"))
+
+	event := <-sub.C
+	if event.Kind != BucketSplit || event.Depth != 0 {
+		t.Errorf("Expected root bucket split, got %v at depth %d", event.Kind, event.Depth)
+	}
+}
+
+func TestDroppedEvents(t *testing.T) {
+	table := NewRoutingTable(selfContact)
+	sub := table.Subscribe(2)
+
+	for i := 0; i < 5; i++ {
+		table.Update(farContact(7000 + i))
+	}
+
+	if sub.Dropped() != 3 {
+		t.Errorf("Expected 3 dropped events, got %d", sub.Dropped())
+	}
+
+	sub.Close()
+	table.Update(farContact(7005))
+	if n := len(sub.C); n != 2 {
+		t.Errorf("Closed subscription should receive nothing more, has %d", n)
+	}
+	if sub.Dropped() != 3 {
+		t.Error("Closed subscription should not count drops")
+	}
+}
+
+func TestSetConfigKeepsSubscriptionsAndMetrics(t *testing.T) {
+	table := NewRoutingTable(selfContact)
+	kept := NewContact(NewRandomNodeID(), "10.0.0.1:6000")
+	dropped := NewContact(NewRandomNodeID(), "10.0.0.2:6000")
+	table.Update(dropped)
+	table.Update(kept)
+	table.RecordSuccess(kept.ID, 10*time.Millisecond)
+
+	sub := table.Subscribe(0)
+	defer sub.Close()
+
+	// Only the most recently seen contact of the subnet fits
+	table.SetConfig(RoutingConfig{MaxSubnetPerTable: 1})
+	expectEvent(t, sub, ContactEvicted, dropped)
+
+	metrics, ok := table.Metrics(kept.ID)
+	if !ok || metrics.RTT != 10*time.Millisecond || metrics.Successes != 1 {
+		t.Errorf("Metrics should survive reconfiguration, got %+v", metrics)
+	}
+
+	table.Remove(kept.ID)
+	expectEvent(t, sub, ContactEvicted, kept)
+}
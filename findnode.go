@@ -1,8 +1,7 @@
 package kademlia
 
 import (
-	"container/heap"
-	"sort"
+	"sync"
 )
 
 type FindNodeRequest struct {
@@ -12,11 +11,8 @@ type FindNodeRequest struct {
 
 func (k *Kademlia) NewFindNodeRequest(target NodeID) FindNodeRequest {
 	return FindNodeRequest{
-		RPCHeader: RPCHeader{
-			Sender:    k.routes.self,
-			NetworkID: k.NetworkID,
-		},
-		Target: target,
+		RPCHeader: k.newRPCHeader(),
+		Target:    target,
 	}
 }
 
@@ -26,28 +22,44 @@ type FindNodeResponse struct {
 }
 
 func (k *Kademlia) FindNode(contact Contact, target NodeID, done chan Contacts) {
-	client, err := dialContact(contact)
+	contacts, err := k.findNode(contact, target)
 	if err != nil {
 		done <- nil
 		return
 	}
 
+	done <- contacts
+}
+
+func (k *Kademlia) findNode(contact Contact, target NodeID) (Contacts, error) {
+	contacts, _, err := k.findNodeHeader(contact, target)
+	return contacts, err
+}
+
+// Also returns the header the responder sent, with what it speaks and offers
+func (k *Kademlia) findNodeHeader(contact Contact, target NodeID) (Contacts,
+	RPCHeader, error) {
 	req := k.NewFindNodeRequest(target)
 	res := FindNodeResponse{}
 
-	err = client.Call("KademliaCore.FindNodeRPC", &req, &res)
+	err := k.call(contact, "KademliaCore.FindNodeRPC", &req, &res)
 	if err != nil {
-		done <- nil
-		return
+		return nil, RPCHeader{}, err
 	}
 
-	k.routes.Update(res.Sender)
+	// Contacts we could never dial are dropped
+	contacts := Contacts{}
+	for _, contact := range res.Contacts {
+		if contact.Validate() == nil {
+			contacts = append(contacts, contact)
+		}
+	}
 
-	done <- res.Contacts
+	return contacts, res.RPCHeader, nil
 }
 
 func (kc *KademliaCore) FindNodeRPC(req FindNodeRequest, res *FindNodeResponse) error {
-	err := kc.kad.HandleRPC(req.RPCHeader, &res.RPCHeader)
+	err := kc.handleRPC(req.RPCHeader, &res.RPCHeader)
 	if err != nil {
 		return err
 	}
@@ -57,47 +69,213 @@ func (kc *KademliaCore) FindNodeRPC(req FindNodeRequest, res *FindNodeResponse)
 }
 
 func (k *Kademlia) IterativeFindNode(target NodeID, delta int, final chan Contacts) {
-	done := make(chan Contacts)
+	k.IterativeFindNodeDisjoint(target, delta, 1, final)
+}
 
-	ret := make(Contacts, BucketSize)
-	frontier := make(Contacts, BucketSize)
-	seen := make(map[string]struct{})
+// S/Kademlia lookup running independent paths over disjoint sets of peers,
+// so that an adversarial node can only steer the path that queried it
+func (k *Kademlia) IterativeFindNodeDisjoint(target NodeID, delta, paths int,
+	final chan Contacts) {
+	l := k.newLookup(target, delta)
+	final <- l.run(k.routes.FindClosest(target, BucketSize), paths)
+}
 
-	for _, node := range k.routes.FindClosest(target, delta) {
-		ret = append(ret, node)
-		heap.Push(&frontier, node)
-		seen[node.ID.String()] = struct{}{}
+// Iterative lookup returning the closest nodes offering required, as each
+// reported in its response whether or not our routing table has room for it.
+// Nodes without it still route the lookup.
+func (k *Kademlia) findCapable(target NodeID, required Capabilities) Contacts {
+	l := k.newLookup(target, Delta)
+	l.query = func(contact Contact, target NodeID) (Contacts, error) {
+		contacts, header, err := k.findNodeHeader(contact, target)
+		if err == nil {
+			l.recordProtocol(header)
+		}
+		return contacts, err
+	}
+	l.accept = func(contact Contact) bool {
+		return l.capable(contact.ID, required)
 	}
 
-	pending := 0
-	for i := 0; i < delta && frontier.Len() > 0; i++ {
-		pending++
-		contact := heap.Pop(&frontier).(Contact)
-		go k.FindNode(contact, target, done)
+	return l.run(k.routes.FindClosest(target, BucketSize), 1)
+}
+
+func (k *Kademlia) newLookup(target NodeID, delta int) *lookup {
+	l := newLookup(k.routes.self.ID, target, delta, k.findNode)
+	l.order = func(contacts Contacts) {
+		k.routes.Order(contacts, target)
 	}
 
-	for pending > 0 {
-		nodes := <-done
-		pending--
-		for _, node := range nodes {
-			if _, ok := seen[node.ID.String()]; !ok {
+	return l
+}
+
+/*
+ * lookup
+ */
+
+type lookup struct {
+	self    NodeID
+	target  NodeID
+	delta   int
+	query   func(Contact, NodeID) (Contacts, error)
+	order   func(Contacts)
+	accept  func(Contact) bool
+	mutex   sync.Mutex
+	claimed map[NodeID]struct{}
+	// Capabilities each responder advertised, guarded by mutex
+	capabilities map[NodeID]Capabilities
+}
+
+func newLookup(self, target NodeID, delta int,
+	query func(Contact, NodeID) (Contacts, error)) *lookup {
+	l := &lookup{
+		self:         self,
+		target:       target,
+		delta:        delta,
+		query:        query,
+		claimed:      make(map[NodeID]struct{}),
+		capabilities: make(map[NodeID]Capabilities),
+	}
+
+	// Closest contacts are queried first unless the caller orders otherwise
+	l.order = func(contacts Contacts) {
+		contacts.SortByDistance(target)
+	}
+
+	return l
+}
+
+func (l *lookup) run(seeds Contacts, paths int) Contacts {
+	if paths < 1 {
+		paths = 1
+	}
+
+	// Deal the closest known contacts round-robin across the paths
+	l.order(seeds)
+	starts := make([]Contacts, paths)
+	for i, seed := range seeds {
+		starts[i%paths] = append(starts[i%paths], seed)
+	}
+
+	results := make(chan Contacts)
+	for _, start := range starts {
+		go func(start Contacts) {
+			results <- l.walk(start)
+		}(start)
+	}
+
+	ret := Contacts{}
+	seen := make(map[NodeID]struct{})
+	for i := 0; i < paths; i++ {
+		for _, node := range <-results {
+			if _, ok := seen[node.ID]; !ok {
 				ret = append(ret, node)
-				heap.Push(&frontier, node)
-				seen[node.ID.String()] = struct{}{}
+				seen[node.ID] = struct{}{}
+			}
+		}
+	}
+
+	ret.SortByDistance(l.target)
+	if ret.Len() > BucketSize {
+		ret = ret[:BucketSize]
+	}
+
+	return ret
+}
+
+type lookupResponse struct {
+	contact  Contact
+	contacts Contacts
+	err      error
+}
+
+// Walks a single path, returning the closest contacts that responded
+func (l *lookup) walk(start Contacts) Contacts {
+	done := make(chan lookupResponse)
+
+	shortlist := Contacts{}
+	responded := Contacts{}
+	seen := make(map[NodeID]struct{})
+	visited := make(map[NodeID]struct{})
+
+	add := func(nodes Contacts) {
+		for _, node := range nodes {
+			if _, ok := seen[node.ID]; !ok && node.ID != l.self {
+				shortlist = append(shortlist, node)
+				seen[node.ID] = struct{}{}
 			}
 		}
+		l.order(shortlist)
+	}
+	add(start)
+
+	pending := 0
+	for {
+		// Only the BucketSize closest contacts are worth querying
+		for i := 0; i < shortlist.Len() && i < BucketSize && pending < l.delta; i++ {
+			contact := shortlist[i]
+			if _, ok := visited[contact.ID]; ok {
+				continue
+			}
+			visited[contact.ID] = struct{}{}
+
+			if !l.claim(contact.ID) {
+				continue
+			}
 
-		for pending < delta && frontier.Len() > 0 {
 			pending++
-			contact := heap.Pop(&frontier).(Contact)
-			go k.FindNode(contact, target, done)
+			go func(contact Contact) {
+				contacts, err := l.query(contact, l.target)
+				done <- lookupResponse{contact, contacts, err}
+			}(contact)
 		}
+
+		if pending == 0 {
+			break
+		}
+
+		res := <-done
+		pending--
+		if res.err != nil {
+			// Unresponsive contacts must not crowd out live ones
+			shortlist.remove(res.contact.ID)
+			continue
+		}
+
+		if l.accept == nil || l.accept(res.contact) {
+			responded = append(responded, res.contact)
+		}
+		add(res.contacts)
 	}
 
-	sort.Sort(ret)
-	if ret.Len() > BucketSize {
-		ret = ret[:BucketSize]
+	return responded
+}
+
+// Reserves a peer for a single path, no peer is queried by two paths
+func (l *lookup) claim(id NodeID) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, ok := l.claimed[id]; ok {
+		return false
 	}
+	l.claimed[id] = struct{}{}
+
+	return true
+}
+
+func (l *lookup) recordProtocol(h RPCHeader) {
+	_, _, capabilities := peerProtocol(h)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.capabilities[h.Sender.ID] = capabilities
+}
+
+func (l *lookup) capable(id NodeID, required Capabilities) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 
-	final <- ret
+	capabilities, ok := l.capabilities[id]
+	return ok && capabilities.Has(required)
 }
@@ -0,0 +1,188 @@
+package kademlia
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+type fakeNetwork struct {
+	tables  map[NodeID]*RoutingTable
+	mutex   sync.Mutex
+	queries map[NodeID]int
+	liars   map[NodeID]Contacts
+}
+
+func newFakeNetwork(size int) *fakeNetwork {
+	return newFakeNetworkWithConfig(size, RoutingConfig{})
+}
+
+func newFakeNetworkWithConfig(size int, config RoutingConfig) *fakeNetwork {
+	network := &fakeNetwork{
+		tables:  make(map[NodeID]*RoutingTable),
+		queries: make(map[NodeID]int),
+		liars:   make(map[NodeID]Contacts),
+	}
+
+	contacts := Contacts{}
+	for i := 0; i < size; i++ {
+		contact := NewContact(NewRandomNodeID(), "")
+		contacts = append(contacts, contact)
+		network.tables[contact.ID] = NewRoutingTableWithConfig(contact, config)
+	}
+
+	for _, table := range network.tables {
+		for _, contact := range contacts {
+			table.Update(contact)
+		}
+	}
+
+	return network
+}
+
+func (n *fakeNetwork) findNode(contact Contact, target NodeID) (Contacts, error) {
+	n.mutex.Lock()
+	n.queries[contact.ID]++
+	lies, lying := n.liars[contact.ID]
+	n.mutex.Unlock()
+
+	table, ok := n.tables[contact.ID]
+	if !ok {
+		return nil, errors.New("Unreachable contact")
+	}
+	if lying {
+		return lies, nil
+	}
+
+	return table.FindClosest(target, BucketSize), nil
+}
+
+func (n *fakeNetwork) closest(target NodeID) Contact {
+	all := Contacts{}
+	for _, table := range n.tables {
+		all = append(all, table.Self())
+	}
+	all.SortByDistance(target)
+
+	return all[0]
+}
+
+func TestLookupFindsClosest(t *testing.T) {
+	network := newFakeNetwork(200)
+	self := NewContact(NewRandomNodeID(), "")
+	table := NewRoutingTable(self)
+	for id := range network.tables {
+		table.Update(NewContact(id, ""))
+		break
+	}
+
+	target := NewRandomNodeID()
+	l := newLookup(self.ID, target, Delta, network.findNode)
+	contacts := l.run(table.FindClosest(target, BucketSize), 1)
+
+	if contacts.Len() == 0 || contacts[0].ID != network.closest(target).ID {
+		t.Error("Lookup should return the closest node in the network first")
+	}
+	if contacts.Len() > BucketSize {
+		t.Error("Lookup should return at most", BucketSize, "contacts")
+	}
+}
+
+func TestDisjointLookupQueriesEachPeerOnce(t *testing.T) {
+	network := newFakeNetwork(200)
+	self := NewContact(NewRandomNodeID(), "")
+	table := NewRoutingTable(self)
+	for id := range network.tables {
+		table.Update(NewContact(id, ""))
+	}
+
+	target := NewRandomNodeID()
+	l := newLookup(self.ID, target, Delta, network.findNode)
+	contacts := l.run(table.FindClosest(target, BucketSize), 4)
+
+	for id, count := range network.queries {
+		if count > 1 {
+			t.Errorf("Peer %s queried %d times across disjoint paths", id, count)
+		}
+	}
+	if contacts.Len() == 0 || contacts[0].ID != network.closest(target).ID {
+		t.Error("Disjoint lookup should return the closest node in the network first")
+	}
+}
+
+func TestDisjointLookupSurvivesLiar(t *testing.T) {
+	network := newFakeNetwork(200)
+	self := NewContact(NewRandomNodeID(), "")
+	target := NewRandomNodeID()
+
+	// Every peer we know initially lies except the ones on one path
+	table := NewRoutingTable(self)
+	for id := range network.tables {
+		table.Update(NewContact(id, ""))
+	}
+	seeds := table.FindClosest(target, BucketSize)
+	seeds.SortByDistance(target)
+
+	fake := Contacts{}
+	for i := 0; i < BucketSize; i++ {
+		id := target
+		id[IDLength-1] ^= byte(i + 1)
+		fake = append(fake, NewContact(id, ""))
+	}
+	for i, seed := range seeds {
+		if i%2 == 0 {
+			network.liars[seed.ID] = fake
+		}
+	}
+
+	l := newLookup(self.ID, target, Delta, network.findNode)
+	contacts := l.run(seeds, 2)
+
+	closest := network.closest(target)
+	for _, contact := range contacts {
+		if contact.ID == closest.ID {
+			return
+		}
+	}
+	t.Error("Honest path should still find the closest node")
+}
+
+// Hops taken by greedily forwarding to the closest contact each node knows,
+// starting from every node towards random targets
+func (n *fakeNetwork) averageHops(lookups int) float64 {
+	starts := Contacts{}
+	for _, table := range n.tables {
+		starts = append(starts, table.Self())
+	}
+
+	hops := 0
+	for i := 0; i < lookups; i++ {
+		target := NewRandomNodeID()
+		current := starts[i%len(starts)]
+
+		for {
+			next := n.tables[current.ID].FindClosest(target, 1)
+			if next.Len() == 0 || !next[0].ID.Xor(target).Less(current.ID.Xor(target)) {
+				break
+			}
+			current = next[0]
+			hops++
+		}
+	}
+
+	return float64(hops) / float64(lookups)
+}
+
+func TestSymbolRoutingReducesHops(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Simulation is slow")
+	}
+
+	standard := newFakeNetwork(1000).averageHops(1000)
+	symbol := newFakeNetworkWithConfig(1000, RoutingConfig{SymbolBits: 4}).averageHops(1000)
+	t.Logf("Average hops: %.2f with b=1, %.2f with b=4", standard, symbol)
+
+	if symbol >= standard {
+		t.Errorf("Symbol routing took %.2f hops, standard took %.2f", symbol, standard)
+	}
+}
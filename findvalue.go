@@ -1,21 +1,21 @@
 package kademlia
 
 import (
+	"errors"
 	"log"
 )
 
 type FindValueRequest struct {
 	RPCHeader
 	Target NodeID
+	// Resumes the provider listing after this provider ID
+	ProvidersAfter NodeID
 }
 
 func (k *Kademlia) NewFindValueRequest(target NodeID) FindValueRequest {
 	return FindValueRequest{
-		RPCHeader: RPCHeader{
-			Sender:    k.routes.self,
-			NetworkID: k.NetworkID,
-		},
-		Target: target,
+		RPCHeader: k.newRPCHeader(),
+		Target:    target,
 	}
 }
 
@@ -23,40 +23,70 @@ type FindValueResponse struct {
 	RPCHeader
 	Contacts Contacts
 	Value    string
+	Record   *Record
+	// One page of live providers, ordered by ID
+	Providers     Contacts
+	MoreProviders bool
 }
 
 func (k *Kademlia) FindValue(contact Contact, target NodeID) ([]Contact, string,
 	error) {
-	client, err := dialContact(contact)
+	record, contacts, err := k.findRecord(contact, target)
 	if err != nil {
 		return nil, "", err
 	}
 
+	if record != nil {
+		return contacts, string(record.Value), nil
+	}
+
+	return contacts, "", nil
+}
+
+// Returns either the record stored under target, verified against it, or the
+// closest contacts known to the remote
+func (k *Kademlia) findRecord(contact Contact, target NodeID) (*Record, Contacts,
+	error) {
 	req := k.NewFindValueRequest(target)
 	res := FindValueResponse{}
 
-	err = client.Call("KademliaCore.FindValueRPC", &req, &res)
+	err := k.call(contact, "KademliaCore.FindValueRPC", &req, &res)
 	if err != nil {
-		return nil, "", err
+		return nil, nil, err
 	}
 
-	return res.Contacts, res.Value, nil
+	if res.Record != nil {
+		err = res.Record.Verify(target)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return res.Record, res.Contacts, nil
 }
 
 func (kc *KademliaCore) FindValueRPC(req FindValueRequest, res *FindValueResponse) error {
-	err := kc.kad.HandleRPC(req.RPCHeader, &res.RPCHeader)
+	err := kc.handleRPC(req.RPCHeader, &res.RPCHeader)
 	if err != nil {
 		return err
 	}
 
-	value, err := kc.kad.valuesDB.Get(req.Target[:], nil)
+	record, err := kc.kad.getRecord(req.Target)
+	if err != nil {
+		log.Println(err)
+		return errors.New("Read from values database failed")
+	}
+
+	res.Providers, res.MoreProviders, err = kc.kad.getProviders(req.Target,
+		req.ProvidersAfter, ProviderPageSize)
 	if err != nil {
 		log.Println(err)
-		panic("Read from values database failed")
+		return errors.New("Read from providers database failed")
 	}
 
-	if value != nil {
-		res.Value = string(value)
+	if record != nil {
+		res.Value = string(record.Value)
+		res.Record = record
 		return nil
 	}
 
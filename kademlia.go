@@ -8,7 +8,7 @@ import (
 	"log"
 	"net"
 	"net/rpc"
-	"time"
+	"sync"
 )
 
 const (
@@ -16,16 +16,39 @@ const (
 )
 
 type Kademlia struct {
-	routes    *RoutingTable
-	valuesDB  *db.DB
-	NetworkID string
+	routes      *RoutingTable
+	valuesDB    *db.DB
+	NetworkID   string
+	Identity    *Identity
+	Difficulty  Difficulty
+	Transport   Transport
+	StoreLimits StoreLimits
+	// Codec is proposed when dialing, gob unless set, and peers may use any
+	// of Codecs, every built-in codec unless set
+	Codec  Codec
+	Codecs []Codec
+	// Advertised to peers, DefaultCapabilities when built by NewKademlia.
+	// Zero offers none.
+	Capabilities Capabilities
+	// Seeds are looked up in the TXT records of SeedDomain when joining
+	// without explicit seeds
+	SeedDomain   string
+	SeedResolver SeedResolver
+	// Addresses served on, the node's own addresses unless set.  "[::]:6000"
+	// listens on every IPv4 and IPv6 interface.
+	ListenAddresses []string
+	peers           peerIdentities
+	storeMutex      sync.Mutex
+	usage           *storeUsage
+	listeners       []net.Listener
 }
 
 func NewKademlia(self Contact, networkID string) *Kademlia {
 	ret := &Kademlia{
-		routes:    NewRoutingTable(self),
-		valuesDB:  nil,
-		NetworkID: networkID,
+		routes:       NewRoutingTable(self),
+		valuesDB:     nil,
+		NetworkID:    networkID,
+		Capabilities: DefaultCapabilities,
 	}
 
 	hexID := hex.EncodeToString(self.ID[:])
@@ -35,16 +58,60 @@ func NewKademlia(self Contact, networkID string) *Kademlia {
 		panic("Unable to open values database")
 	}
 
-	defer conn.Close()
 	ret.valuesDB = conn
+	if err := ret.migrateLegacyValues(); err != nil {
+		log.Println(err)
+		panic("Unable to migrate values database")
+	}
 
 	return ret
 }
 
+func (k *Kademlia) Close() error {
+	for _, l := range k.listeners {
+		l.Close()
+	}
+
+	if k.valuesDB != nil {
+		return k.valuesDB.Close()
+	}
+
+	return nil
+}
+
+// Rebuilds the routing table under config, keeping known contacts, their
+// metrics and event subscriptions
+func (k *Kademlia) SetRoutingConfig(config RoutingConfig) {
+	k.routes.SetConfig(config)
+}
+
 // Generic RPC base
 type RPCHeader struct {
 	Sender    Contact
 	NetworkID string
+	PublicKey []byte
+	Nonce     NodeID
+	// Protocol versions spoken by the sender and its capabilities
+	Version      uint32
+	MinVersion   uint32
+	Capabilities Capabilities
+}
+
+func (k *Kademlia) newRPCHeader() RPCHeader {
+	header := RPCHeader{
+		Sender:       k.routes.self,
+		NetworkID:    k.NetworkID,
+		Version:      ProtocolVersion,
+		MinVersion:   MinProtocolVersion,
+		Capabilities: k.Capabilities,
+	}
+
+	if k.Identity != nil {
+		header.PublicKey = k.Identity.PublicKey
+		header.Nonce = k.Identity.Nonce
+	}
+
+	return header
 }
 
 // Every RPC updates routing tables in Kademlia
@@ -53,41 +120,155 @@ func (k *Kademlia) HandleRPC(request RPCHeader, response *RPCHeader) error {
 		return errors.New(fmt.Sprintf("Expected Network ID %s, go %s", k.NetworkID, request.NetworkID))
 	}
 
+	err := checkProtocol(request)
+	if err != nil {
+		return err
+	}
+
+	// Senders without an address cannot be dialed back and stay out of the
+	// routing table
+	client := request.Sender.isClient()
+	if !client {
+		err = request.Sender.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Refuse contacts that have not solved the network's crypto puzzles
+	err = VerifyPuzzle(request.Sender.ID, request.PublicKey, request.Nonce, k.Difficulty)
+	if err != nil {
+		return err
+	}
+
 	// Update routing table for all incoming RPCs
-	k.routes.Update(request.Sender)
+	if !client && !k.peers.isPenalized(request.Sender.Address) {
+		k.routes.UpdateUnverified(request.Sender)
+		k.routes.recordProtocol(request)
+	}
 	// Pong with sender
-	response.Sender = k.routes.self
+	*response = k.newRPCHeader()
 
 	return nil
 }
 
-func dialContact(contact Contact) (*rpc.Client, error) {
-	connection, err := net.DialTimeout("tcp", contact.Address, 5*time.Second)
+func (k *Kademlia) transport() Transport {
+	if k.Transport == nil {
+		return TCPTransport{}
+	}
+	return k.Transport
+}
+
+// Dials contact at the first of addresses to connect, returning the address
+// reached and the remote's NodeID if the transport proved it
+func (k *Kademlia) dialContact(contact Contact, addresses []string) (*rpc.Client,
+	string, *NodeID, error) {
+	connection, reached, err := dialHappyEyeballs(k.transport(), contact, addresses)
 	if err != nil {
-		return nil, err
+		return nil, "", nil, err
 	}
 
-	return rpc.NewClient(connection), nil
+	proven, err := k.transport().RemoteID(connection)
+	if err != nil {
+		connection.Close()
+		return nil, "", nil, err
+	}
+
+	codec := k.codec()
+	proposed, err := proposeCodec(connection, codec)
+	if err != nil {
+		connection.Close()
+		return nil, "", nil, err
+	}
+
+	return codec.NewClient(proposed), reached, proven, nil
 }
 
 func (k *Kademlia) Serve() error {
-	rpc.Register(&KademliaCore{k})
+	addresses := k.ListenAddresses
+	if len(addresses) == 0 {
+		addresses = k.routes.self.Addresses()
+	}
 
-	l, err := net.Listen("tcp", k.routes.self.Address)
-	if err != nil {
-		return err
+	listeners := []net.Listener{}
+	for _, address := range addresses {
+		l, err := k.transport().Listen(address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, l)
 	}
 
-	go rpc.Accept(l)
+	k.listeners = listeners
+	for _, l := range listeners {
+		go k.accept(l)
+	}
 
 	return nil
 }
 
+func (k *Kademlia) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Println(err)
+			return
+		}
+
+		go k.serveConn(conn)
+	}
+}
+
+// Each connection gets its own server so handlers know who they talk to
+func (k *Kademlia) serveConn(conn net.Conn) {
+	remote, err := k.transport().RemoteID(conn)
+	if err != nil {
+		log.Println(err)
+		conn.Close()
+		return
+	}
+
+	codec, accepted, err := k.acceptCodec(conn)
+	if err != nil {
+		log.Println(err)
+		conn.Close()
+		return
+	}
+
+	// Stores are charged to the remote IP, or the whole address where it has
+	// no port
+	remoteIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		remoteIP = conn.RemoteAddr().String()
+	}
+
+	server := rpc.NewServer()
+	server.Register(&KademliaCore{kad: k, remote: remote, remoteIP: remoteIP})
+	codec.ServeConn(server, accepted)
+}
+
 /*
  * KademliaCore
  * Handles RPC interactions between client/server
  */
 
 type KademliaCore struct {
-	kad *Kademlia
+	kad      *Kademlia
+	remote   *NodeID
+	remoteIP string
+}
+
+// Senders on authenticated transports must claim the ID they proved
+func (kc *KademliaCore) handleRPC(request RPCHeader, response *RPCHeader) error {
+	if kc.remote != nil && request.Sender.ID != *kc.remote {
+		return fmt.Errorf("Sender claims Node ID %s, authenticated as %s",
+			request.Sender.ID, *kc.remote)
+	}
+
+	return kc.kad.HandleRPC(request, response)
 }
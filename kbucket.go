@@ -7,20 +7,28 @@ import (
 
 type ContactList *list.List
 
+// A KBucket holds contacts whose IDs share their first depth bits with prefix
 type KBucket struct {
 	*list.List
+	prefix NodeID
+	depth  int
+	// Contacts seen while the bucket was full, most recently seen last
+	replacements []SeenContact
 }
 
 func NewKBucket() *KBucket {
 	return &KBucket{
-		list.New(),
+		List: list.New(),
 	}
 }
 
-func (kb *KBucket) Update(contact Contact) {
+// Returns whether contact is held by the bucket afterwards
+func (kb *KBucket) Update(contact Contact) bool {
 	foundPtr := kb.findContact(contact)
 	if foundPtr != nil {
-		// If entry is already in KBucket, move it to back of list
+		// If entry is already in KBucket, take its latest addresses and move
+		// it to back of list
+		foundPtr.Value = contact
 		kb.MoveToBack(foundPtr)
 	} else if kb.isFull() {
 		// Ping node, and remove if unresponsive
@@ -28,10 +36,80 @@ func (kb *KBucket) Update(contact Contact) {
 
 		//kb.Remove(bucket.Front())
 		//kb.PushBack(foundPtr)
+		return false
 	} else {
 		// KBucket is not full, simply add contact
 		kb.PushBack(contact)
 	}
+
+	return true
+}
+
+func (kb *KBucket) covers(nodeID NodeID) bool {
+	return nodeID.Xor(kb.prefix).leadingZeros() >= kb.depth
+}
+
+// The smallest distance from target to any ID the bucket could hold
+func (kb *KBucket) minDistance(target NodeID) (ret NodeID) {
+	distance := target.Xor(kb.prefix)
+	for i := 0; i < kb.depth; i++ {
+		if distance.bit(i) == 1 {
+			ret.flipBit(i)
+		}
+	}
+
+	return
+}
+
+// Divides the bucket's range in two on the next bit, preserving the order of
+// contacts within each half
+func (kb *KBucket) split() (*KBucket, *KBucket) {
+	zero := &KBucket{List: list.New(), prefix: kb.prefix, depth: kb.depth + 1}
+	one := &KBucket{List: list.New(), prefix: kb.prefix, depth: kb.depth + 1}
+	one.prefix.flipBit(kb.depth)
+
+	for el := kb.Front(); el != nil; el = el.Next() {
+		contact := el.Value.(Contact)
+		if contact.ID.bit(kb.depth) == 0 {
+			zero.PushBack(contact)
+		} else {
+			one.PushBack(contact)
+		}
+	}
+
+	for _, replacement := range kb.replacements {
+		if replacement.ID.bit(kb.depth) == 0 {
+			zero.replacements = append(zero.replacements, replacement)
+		} else {
+			one.replacements = append(one.replacements, replacement)
+		}
+	}
+
+	return zero, one
+}
+
+func (kb *KBucket) addReplacement(contact SeenContact) {
+	kb.removeReplacement(contact.ID)
+	kb.replacements = append(kb.replacements, contact)
+	if len(kb.replacements) > ReplacementCacheSize {
+		kb.replacements = kb.replacements[1:]
+	}
+}
+
+func (kb *KBucket) removeReplacement(nodeID NodeID) {
+	for i, replacement := range kb.replacements {
+		if replacement.ID == nodeID {
+			kb.replacements = append(kb.replacements[:i], kb.replacements[i+1:]...)
+			return
+		}
+	}
+}
+
+func (kb *KBucket) appendContacts(contacts Contacts) Contacts {
+	for el := kb.Front(); el != nil; el = el.Next() {
+		contacts = append(contacts, el.Value.(Contact))
+	}
+	return contacts
 }
 
 func (kb KBucket) findContact(contact Contact) *list.Element {
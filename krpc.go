@@ -0,0 +1,636 @@
+package kademlia
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// How long to wait for a KRPC response
+	KRPCTimeout = 2 * time.Second
+	// Largest datagram read
+	MaxKRPCMessage = 8192
+	// Tokens are valid until the secret is rotated twice
+	TokenRotation = 5 * time.Minute
+	// How long announced peers are kept
+	PeerTTL = 30 * time.Minute
+	// Peers returned by get_peers and kept per info hash
+	MaxPeerValues   = 50
+	MaxPeersPerHash = 1000
+	// Bytes of each compact node info
+	CompactNodeLength = IDLength + 6
+)
+
+// KRPC error codes from BEP 5
+const (
+	KRPCGenericError  = 201
+	KRPCServerError   = 202
+	KRPCProtocolError = 203
+	KRPCMethodUnknown = 204
+)
+
+// An error message received from, or sent to, a KRPC peer
+type KRPCError struct {
+	Code    int64
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("KRPC error %d: %s", e.Code, e.Message)
+}
+
+/*
+ * KRPC
+ * BitTorrent Mainline DHT (BEP 5) node speaking bencoded KRPC over UDP.  It
+ * keeps its own routing table of UDP contacts under the same NodeID.
+ */
+
+type KRPC struct {
+	routes *RoutingTable
+	conn   *net.UDPConn
+	tokens tokenSecrets
+	mutex  sync.Mutex
+	// Outstanding queries by transaction ID
+	pending map[string]pendingQuery
+	nextTx  uint16
+	peers   map[NodeID]map[string]time.Time
+}
+
+func ListenKRPC(id NodeID, address string) (*KRPC, error) {
+	addr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &KRPC{
+		routes:  NewRoutingTable(NewContact(id, conn.LocalAddr().String())),
+		conn:    conn,
+		pending: make(map[string]pendingQuery),
+		peers:   make(map[NodeID]map[string]time.Time),
+	}
+	if err := d.tokens.rotate(time.Now()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go d.receive()
+
+	return d, nil
+}
+
+func (d *KRPC) Close() error {
+	return d.conn.Close()
+}
+
+func (d *KRPC) Self() Contact {
+	return d.routes.Self()
+}
+
+func (d *KRPC) Routes() *RoutingTable {
+	return d.routes
+}
+
+/*
+ * Queries
+ */
+
+func (d *KRPC) Ping(address string) (Contact, error) {
+	res, err := d.query(address, "ping", map[string]interface{}{})
+	if err != nil {
+		return Contact{}, err
+	}
+
+	return NewContact(res.id, address), nil
+}
+
+func (d *KRPC) FindNode(contact Contact, target NodeID) (Contacts, error) {
+	res, err := d.query(contact.Address, "find_node", map[string]interface{}{
+		"target": string(target[:]),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeCompactNodes(res.dict["nodes"])
+}
+
+// Asks contact for peers of infoHash, returning the peers it knows or the
+// nodes closer to infoHash, and a token for announcing to it
+func (d *KRPC) GetPeers(contact Contact, infoHash NodeID) ([]*net.UDPAddr,
+	Contacts, string, error) {
+	res, err := d.query(contact.Address, "get_peers", map[string]interface{}{
+		"info_hash": string(infoHash[:]),
+	})
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	token, _ := res.dict["token"].(string)
+
+	peers := []*net.UDPAddr{}
+	if values, ok := res.dict["values"].([]interface{}); ok {
+		for _, value := range values {
+			compact, ok := value.(string)
+			if !ok || len(compact) != 6 {
+				return nil, nil, "", errors.New("Invalid compact peer info")
+			}
+			peers = append(peers, decodeCompactAddr(compact))
+		}
+	}
+
+	nodes, err := decodeCompactNodes(res.dict["nodes"])
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	return peers, nodes, token, nil
+}
+
+// Announces that we have peers of infoHash on port.  With impliedPort the
+// port our query came from is used instead.
+func (d *KRPC) AnnouncePeer(contact Contact, infoHash NodeID, port int, token string,
+	impliedPort bool) error {
+	args := map[string]interface{}{
+		"info_hash": string(infoHash[:]),
+		"port":      port,
+		"token":     token,
+	}
+	if impliedPort {
+		args["implied_port"] = 1
+	}
+
+	_, err := d.query(contact.Address, "announce_peer", args)
+	return err
+}
+
+// Iterative find_node over KRPC, returning the closest responders
+func (d *KRPC) Lookup(target NodeID) Contacts {
+	l := newLookup(d.routes.Self().ID, target, Delta, d.FindNode)
+	return l.run(d.routes.FindClosest(target, BucketSize), 1)
+}
+
+type krpcMessage struct {
+	dict map[string]interface{}
+	id   NodeID
+	err  error
+}
+
+// Responses are only accepted from the address queried
+type pendingQuery struct {
+	address   string
+	responses chan krpcMessage
+}
+
+func (d *KRPC) query(address, method string, args map[string]interface{}) (krpcMessage, error) {
+	addr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return krpcMessage{}, err
+	}
+
+	self := d.routes.Self().ID
+	args["id"] = string(self[:])
+
+	responses := make(chan krpcMessage, 1)
+	d.mutex.Lock()
+	d.nextTx++
+	tx := string([]byte{byte(d.nextTx >> 8), byte(d.nextTx)})
+	d.pending[tx] = pendingQuery{addr.String(), responses}
+	d.mutex.Unlock()
+
+	defer func() {
+		d.mutex.Lock()
+		delete(d.pending, tx)
+		d.mutex.Unlock()
+	}()
+
+	err = d.send(addr, map[string]interface{}{
+		"t": tx,
+		"y": "q",
+		"q": method,
+		"a": args,
+	})
+	if err != nil {
+		return krpcMessage{}, err
+	}
+
+	select {
+	case res := <-responses:
+		if res.err != nil {
+			return krpcMessage{}, res.err
+		}
+		d.routes.Update(NewContact(res.id, addr.String()))
+		return res, nil
+	case <-time.After(KRPCTimeout):
+		d.routes.RecordFailure(d.idAt(addr))
+		return krpcMessage{}, fmt.Errorf("KRPC %s to %s timed out", method, address)
+	}
+}
+
+// The ID of the contact in our table at addr, if any
+func (d *KRPC) idAt(addr *net.UDPAddr) NodeID {
+	id := NodeID{}
+	d.routes.ForEach(func(contact Contact) bool {
+		if contact.Address == addr.String() {
+			id = contact.ID
+			return false
+		}
+		return true
+	})
+
+	return id
+}
+
+func (d *KRPC) send(addr *net.UDPAddr, message map[string]interface{}) error {
+	data, err := bencode(message)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.conn.WriteToUDP(data, addr)
+	return err
+}
+
+func (d *KRPC) receive() {
+	buffer := make([]byte, MaxKRPCMessage)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		v, err := bdecode(buffer[:n])
+		if err != nil {
+			continue
+		}
+		message, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		tx, ok := message["t"].(string)
+		if !ok {
+			continue
+		}
+
+		switch message["y"] {
+		case "q":
+			d.handleQuery(addr, tx, message)
+		case "r":
+			dict, _ := message["r"].(map[string]interface{})
+			id, err := krpcID(dict)
+			d.deliver(addr, tx, krpcMessage{dict: dict, id: id, err: err})
+		case "e":
+			d.deliver(addr, tx, krpcMessage{err: decodeKRPCError(message["e"])})
+		}
+	}
+}
+
+func (d *KRPC) deliver(addr *net.UDPAddr, tx string, message krpcMessage) {
+	d.mutex.Lock()
+	query, ok := d.pending[tx]
+	d.mutex.Unlock()
+
+	if ok && query.address == addr.String() {
+		select {
+		case query.responses <- message:
+		default:
+		}
+	}
+}
+
+/*
+ * Query handlers
+ */
+
+func (d *KRPC) handleQuery(addr *net.UDPAddr, tx string, message map[string]interface{}) {
+	method, _ := message["q"].(string)
+	args, ok := message["a"].(map[string]interface{})
+	if !ok {
+		d.sendError(addr, tx, KRPCProtocolError, "Missing arguments")
+		return
+	}
+
+	sender, err := krpcID(args)
+	if err != nil {
+		d.sendError(addr, tx, KRPCProtocolError, err.Error())
+		return
+	}
+
+	var res map[string]interface{}
+	switch method {
+	case "ping":
+		res = map[string]interface{}{}
+	case "find_node":
+		res, err = d.handleFindNode(args)
+	case "get_peers":
+		res, err = d.handleGetPeers(addr, args)
+	case "announce_peer":
+		res, err = d.handleAnnouncePeer(addr, args)
+	default:
+		d.sendError(addr, tx, KRPCMethodUnknown, "Method Unknown")
+		return
+	}
+
+	if err != nil {
+		d.sendError(addr, tx, KRPCProtocolError, err.Error())
+		return
+	}
+
+	d.routes.Update(NewContact(sender, addr.String()))
+
+	self := d.routes.Self().ID
+	res["id"] = string(self[:])
+	d.send(addr, map[string]interface{}{
+		"t": tx,
+		"y": "r",
+		"r": res,
+	})
+}
+
+func (d *KRPC) sendError(addr *net.UDPAddr, tx string, code int64, text string) {
+	d.send(addr, map[string]interface{}{
+		"t": tx,
+		"y": "e",
+		"e": []interface{}{code, text},
+	})
+}
+
+func (d *KRPC) handleFindNode(args map[string]interface{}) (map[string]interface{}, error) {
+	target, err := krpcNodeID(args, "target")
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"nodes": encodeCompactNodes(d.routes.FindClosest(target, BucketSize)),
+	}, nil
+}
+
+func (d *KRPC) handleGetPeers(addr *net.UDPAddr,
+	args map[string]interface{}) (map[string]interface{}, error) {
+	infoHash, err := krpcNodeID(args, "info_hash")
+	if err != nil {
+		return nil, err
+	}
+
+	res := map[string]interface{}{
+		"token": d.tokens.token(addr.IP, time.Now()),
+	}
+
+	if values := d.getPeers(infoHash); len(values) > 0 {
+		res["values"] = values
+	} else {
+		res["nodes"] = encodeCompactNodes(d.routes.FindClosest(infoHash, BucketSize))
+	}
+
+	return res, nil
+}
+
+func (d *KRPC) handleAnnouncePeer(addr *net.UDPAddr,
+	args map[string]interface{}) (map[string]interface{}, error) {
+	infoHash, err := krpcNodeID(args, "info_hash")
+	if err != nil {
+		return nil, err
+	}
+
+	token, _ := args["token"].(string)
+	if !d.tokens.valid(token, addr.IP, time.Now()) {
+		return nil, errors.New("Invalid token")
+	}
+
+	port, _ := args["port"].(int64)
+	if implied, _ := args["implied_port"].(int64); implied != 0 {
+		port = int64(addr.Port)
+	}
+	if port <= 0 || port > 65535 {
+		return nil, errors.New("Invalid port")
+	}
+
+	d.addPeer(infoHash, &net.UDPAddr{IP: addr.IP, Port: int(port)})
+	return map[string]interface{}{}, nil
+}
+
+/*
+ * Peer storage
+ */
+
+func (d *KRPC) addPeer(infoHash NodeID, peer *net.UDPAddr) {
+	compact := encodeCompactAddr(peer)
+	if compact == "" {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	peers, ok := d.peers[infoHash]
+	if !ok {
+		peers = make(map[string]time.Time)
+		d.peers[infoHash] = peers
+	}
+
+	if _, ok := peers[compact]; ok || len(peers) < MaxPeersPerHash {
+		peers[compact] = time.Now().Add(PeerTTL)
+	}
+}
+
+// Up to MaxPeerValues live peers in compact form, dropping expired ones
+func (d *KRPC) getPeers(infoHash NodeID) []interface{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	values := []interface{}{}
+	now := time.Now()
+	for compact, expires := range d.peers[infoHash] {
+		if now.After(expires) {
+			delete(d.peers[infoHash], compact)
+			continue
+		}
+		if len(values) < MaxPeerValues {
+			values = append(values, compact)
+		}
+	}
+
+	return values
+}
+
+/*
+ * tokenSecrets
+ * Tokens are an HMAC of the requester's IP under a secret rotated every
+ * TokenRotation, accepted under the current and previous secret
+ */
+
+type tokenSecrets struct {
+	mutex    sync.Mutex
+	current  [20]byte
+	previous [20]byte
+	rotated  time.Time
+}
+
+func (s *tokenSecrets) rotate(now time.Time) error {
+	s.previous = s.current
+	if _, err := rand.Read(s.current[:]); err != nil {
+		return err
+	}
+	s.rotated = now
+
+	return nil
+}
+
+func (s *tokenSecrets) refresh(now time.Time) {
+	for now.Sub(s.rotated) >= TokenRotation {
+		if s.rotate(s.rotated.Add(TokenRotation)) != nil {
+			return
+		}
+	}
+}
+
+func tokenFor(secret []byte, ip net.IP) string {
+	mac := hmac.New(sha1.New, secret)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	mac.Write(ip)
+
+	return string(mac.Sum(nil)[:8])
+}
+
+func (s *tokenSecrets) token(ip net.IP, now time.Time) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.refresh(now)
+	return tokenFor(s.current[:], ip)
+}
+
+func (s *tokenSecrets) valid(token string, ip net.IP, now time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.refresh(now)
+	return hmac.Equal([]byte(token), []byte(tokenFor(s.current[:], ip))) ||
+		hmac.Equal([]byte(token), []byte(tokenFor(s.previous[:], ip)))
+}
+
+/*
+ * Compact encodings
+ */
+
+func krpcID(dict map[string]interface{}) (NodeID, error) {
+	return krpcNodeID(dict, "id")
+}
+
+func krpcNodeID(dict map[string]interface{}, key string) (id NodeID, err error) {
+	value, ok := dict[key].(string)
+	if !ok || len(value) != IDLength {
+		return id, fmt.Errorf("Missing or invalid %s", key)
+	}
+
+	copy(id[:], value)
+	return id, nil
+}
+
+func decodeKRPCError(v interface{}) error {
+	list, ok := v.([]interface{})
+	if !ok || len(list) != 2 {
+		return &KRPCError{KRPCGenericError, "Malformed error"}
+	}
+
+	code, _ := list[0].(int64)
+	text, _ := list[1].(string)
+	return &KRPCError{code, text}
+}
+
+// IPv4 address and port in 6 bytes, empty for other addresses
+func encodeCompactAddr(addr *net.UDPAddr) string {
+	ip4 := addr.IP.To4()
+	if ip4 == nil {
+		return ""
+	}
+
+	compact := make([]byte, 6)
+	copy(compact, ip4)
+	binary.BigEndian.PutUint16(compact[4:], uint16(addr.Port))
+
+	return string(compact)
+}
+
+func decodeCompactAddr(compact string) *net.UDPAddr {
+	return &net.UDPAddr{
+		IP:   net.IPv4(compact[0], compact[1], compact[2], compact[3]),
+		Port: int(binary.BigEndian.Uint16([]byte(compact[4:6]))),
+	}
+}
+
+// Contacts with an IPv4 address as concatenated compact node infos
+func encodeCompactNodes(contacts Contacts) string {
+	compact := []byte{}
+	for _, contact := range contacts {
+		info := compactContactAddr(contact)
+		if info == "" {
+			continue
+		}
+		compact = append(compact, contact.ID[:]...)
+		compact = append(compact, info...)
+	}
+
+	return string(compact)
+}
+
+// The first IPv4 address of contact in compact form
+func compactContactAddr(contact Contact) string {
+	for _, address := range contact.Addresses() {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			continue
+		}
+		portNumber, err := strconv.Atoi(port)
+		if err != nil {
+			continue
+		}
+
+		info := encodeCompactAddr(&net.UDPAddr{IP: net.ParseIP(host), Port: portNumber})
+		if info != "" {
+			return info
+		}
+	}
+
+	return ""
+}
+
+func decodeCompactNodes(v interface{}) (Contacts, error) {
+	if v == nil {
+		return Contacts{}, nil
+	}
+
+	compact, ok := v.(string)
+	if !ok || len(compact)%CompactNodeLength != 0 {
+		return nil, errors.New("Invalid compact node info")
+	}
+
+	contacts := Contacts{}
+	for ; len(compact) > 0; compact = compact[CompactNodeLength:] {
+		id := NodeID{}
+		copy(id[:], compact[:IDLength])
+		addr := decodeCompactAddr(compact[IDLength:CompactNodeLength])
+		contacts = append(contacts, NewContact(id, addr.String()))
+	}
+
+	return contacts, nil
+}
@@ -0,0 +1,148 @@
+package kademlia
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestKRPC(t *testing.T) *KRPC {
+	d, err := ListenKRPC(NewRandomNodeID(), "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	return d
+}
+
+func TestKRPCPingAndFindNode(t *testing.T) {
+	a, b, c := newTestKRPC(t), newTestKRPC(t), newTestKRPC(t)
+
+	contact, err := a.Ping(b.Self().Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contact != b.Self() {
+		t.Errorf("Expected to learn %v, got %v", b.Self(), contact)
+	}
+	if !a.Routes().Contains(b.Self().ID) || !b.Routes().Contains(a.Self().ID) {
+		t.Error("Both sides of a ping should update their routing tables")
+	}
+
+	if _, err := c.Ping(b.Self().Address); err != nil {
+		t.Fatal(err)
+	}
+
+	// b knows c, so a learns of c through b
+	closest := a.Lookup(c.Self().ID)
+	if closest.Len() == 0 || closest[0] != c.Self() {
+		t.Errorf("Lookup should find c first, got %v", closest)
+	}
+}
+
+func TestKRPCAnnounceAndGetPeers(t *testing.T) {
+	server, client := newTestKRPC(t), newTestKRPC(t)
+	infoHash := NewRandomNodeID()
+
+	peers, _, token, err := client.GetPeers(server.Self(), infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 0 || token == "" {
+		t.Fatalf("Expected no peers and a token, got %v, %q", peers, token)
+	}
+
+	err = client.AnnouncePeer(server.Self(), infoHash, 6881, "forged", false)
+	var krpcErr *KRPCError
+	if !errors.As(err, &krpcErr) || krpcErr.Code != KRPCProtocolError {
+		t.Errorf("Announce with a bad token should fail with a protocol error, got %v", err)
+	}
+
+	if err := client.AnnouncePeer(server.Self(), infoHash, 6881, token, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AnnouncePeer(server.Self(), infoHash, 0, token, true); err != nil {
+		t.Fatal(err)
+	}
+
+	peers, _, _, err = client.GetPeers(server.Self(), infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]bool{
+		"127.0.0.1:6881":      true,
+		client.Self().Address: true,
+	}
+	if len(peers) != 2 {
+		t.Fatalf("Expected 2 peers, got %v", peers)
+	}
+	for _, peer := range peers {
+		if !expected[peer.String()] {
+			t.Errorf("Unexpected peer %v", peer)
+		}
+	}
+}
+
+func TestKRPCUnknownMethod(t *testing.T) {
+	server, client := newTestKRPC(t), newTestKRPC(t)
+
+	_, err := client.query(server.Self().Address, "vote", map[string]interface{}{})
+	var krpcErr *KRPCError
+	if !errors.As(err, &krpcErr) || krpcErr.Code != KRPCMethodUnknown {
+		t.Errorf("Expected method unknown error, got %v", err)
+	}
+}
+
+func TestTokenRotation(t *testing.T) {
+	secrets := tokenSecrets{}
+	now := time.Now()
+	secrets.rotate(now)
+
+	ip := net.ParseIP("10.0.0.1")
+	token := secrets.token(ip, now)
+
+	if !secrets.valid(token, ip, now) {
+		t.Error("Fresh token should be valid")
+	}
+	if secrets.valid(token, net.ParseIP("10.0.0.2"), now) {
+		t.Error("Token should only be valid for the IP it was issued to")
+	}
+	if !secrets.valid(token, ip, now.Add(TokenRotation)) {
+		t.Error("Token should survive one rotation")
+	}
+	if secrets.valid(token, ip, now.Add(2*TokenRotation)) {
+		t.Error("Token should expire after two rotations")
+	}
+}
+
+func TestCompactNodes(t *testing.T) {
+	contacts := Contacts{
+		NewContact(NewRandomNodeID(), "10.0.0.1:6881"),
+		NewContact(NewRandomNodeID(), "[::1]:6881"),
+		NewContact(NewRandomNodeID(), "192.168.1.2:51413"),
+	}
+
+	encoded := encodeCompactNodes(contacts)
+	if len(encoded) != 2*CompactNodeLength {
+		t.Fatalf("Expected 2 compact nodes, got %d bytes", len(encoded))
+	}
+
+	decoded, err := decodeCompactNodes(encoded)
+	if err != nil || decoded.Len() != 2 || decoded[0] != contacts[0] || decoded[1] != contacts[2] {
+		t.Errorf("Compact nodes did not round trip: %v, %v", decoded, err)
+	}
+
+	if _, err := decodeCompactNodes(encoded[1:]); err == nil {
+		t.Error("Truncated compact nodes should be rejected")
+	}
+
+	// Dual-stack contacts travel by their IPv4 address
+	dual, _ := NewMultiContact(NewRandomNodeID(), "[2001:db8::1]:6881", "10.0.0.2:6881")
+	decoded, err = decodeCompactNodes(encodeCompactNodes(Contacts{dual}))
+	if err != nil || decoded.Len() != 1 || decoded[0] != NewContact(dual.ID, "10.0.0.2:6881") {
+		t.Errorf("Expected the IPv4 address of %v, got %v, %v", dual, decoded, err)
+	}
+}
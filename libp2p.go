@@ -0,0 +1,614 @@
+package kademlia
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// Protocol ID libp2p hosts register the DHT stream handler under
+	Libp2pProtocolID = "/ipfs/kad/1.0.0"
+	// Largest message accepted, libp2p's network.MessageSizeMax
+	MaxLibp2pMessage = 4 << 20
+)
+
+type Libp2pMessageType int32
+
+const (
+	Libp2pPutValue Libp2pMessageType = iota
+	Libp2pGetValue
+	Libp2pAddProvider
+	Libp2pGetProviders
+	Libp2pFindNode
+	Libp2pPing
+)
+
+func (t Libp2pMessageType) String() string {
+	switch t {
+	case Libp2pPutValue:
+		return "PUT_VALUE"
+	case Libp2pGetValue:
+		return "GET_VALUE"
+	case Libp2pAddProvider:
+		return "ADD_PROVIDER"
+	case Libp2pGetProviders:
+		return "GET_PROVIDERS"
+	case Libp2pFindNode:
+		return "FIND_NODE"
+	case Libp2pPing:
+		return "PING"
+	}
+
+	return "UNKNOWN"
+}
+
+// What the sender knows of its connection to a peer
+type Libp2pConnection int32
+
+const (
+	Libp2pNotConnected Libp2pConnection = iota
+	Libp2pConnected
+	Libp2pCanConnect
+	Libp2pCannotConnect
+)
+
+/*
+ * Libp2pMessage
+ * The dht.pb.Message of go-libp2p-kad-dht.  Requests and responses share it,
+ * carried over a stream with each message prefixed by its varint length.
+ */
+
+type Libp2pMessage struct {
+	Type            Libp2pMessageType
+	ClusterLevelRaw int32
+	Key             []byte
+	Record          *Libp2pRecord
+	CloserPeers     []Libp2pPeer
+	ProviderPeers   []Libp2pPeer
+}
+
+// A peer ID multihash and its binary multiaddrs
+type Libp2pPeer struct {
+	ID         []byte
+	Addrs      [][]byte
+	Connection Libp2pConnection
+}
+
+// The record.pb.Record of go-libp2p-record
+type Libp2pRecord struct {
+	Key          []byte
+	Value        []byte
+	TimeReceived string
+}
+
+func (m *Libp2pMessage) marshalProto(e *protoEncoder) {
+	e.uint(1, uint64(m.Type))
+	e.bytes(2, m.Key)
+	if m.Record != nil {
+		e.message(3, m.Record)
+	}
+	for i := range m.CloserPeers {
+		e.message(8, &m.CloserPeers[i])
+	}
+	for i := range m.ProviderPeers {
+		e.message(9, &m.ProviderPeers[i])
+	}
+	e.int(10, int64(m.ClusterLevelRaw))
+}
+
+func (m *Libp2pMessage) unmarshalProto(data []byte) error {
+	return decodeProto(data, func(f protoField) (err error) {
+		var v int64
+		switch f.num {
+		case 1:
+			v, err = f.int()
+			m.Type = Libp2pMessageType(v)
+		case 2:
+			m.Key, err = f.data()
+		case 3:
+			m.Record = &Libp2pRecord{}
+			err = f.message(m.Record)
+		case 8:
+			m.CloserPeers, err = f.libp2pPeer(m.CloserPeers)
+		case 9:
+			m.ProviderPeers, err = f.libp2pPeer(m.ProviderPeers)
+		case 10:
+			v, err = f.int()
+			m.ClusterLevelRaw = int32(v)
+		}
+		return
+	})
+}
+
+func (f protoField) libp2pPeer(peers []Libp2pPeer) ([]Libp2pPeer, error) {
+	peer := Libp2pPeer{}
+	if err := f.message(&peer); err != nil {
+		return peers, err
+	}
+
+	return append(peers, peer), nil
+}
+
+func (p *Libp2pPeer) marshalProto(e *protoEncoder) {
+	e.bytes(1, p.ID)
+	for _, addr := range p.Addrs {
+		e.tag(2, protoBytes)
+		e.buf = binary.AppendUvarint(e.buf, uint64(len(addr)))
+		e.buf = append(e.buf, addr...)
+	}
+	e.uint(3, uint64(p.Connection))
+}
+
+func (p *Libp2pPeer) unmarshalProto(data []byte) error {
+	return decodeProto(data, func(f protoField) (err error) {
+		var v uint64
+		switch f.num {
+		case 1:
+			p.ID, err = f.data()
+		case 2:
+			var addr []byte
+			addr, err = f.data()
+			p.Addrs = append(p.Addrs, addr)
+		case 3:
+			v, err = f.uint()
+			p.Connection = Libp2pConnection(v)
+		}
+		return
+	})
+}
+
+func (r *Libp2pRecord) marshalProto(e *protoEncoder) {
+	e.bytes(1, r.Key)
+	e.bytes(2, r.Value)
+	e.string(5, r.TimeReceived)
+}
+
+func (r *Libp2pRecord) unmarshalProto(data []byte) error {
+	return decodeProto(data, func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			r.Key, err = f.data()
+		case 2:
+			r.Value, err = f.data()
+		case 5:
+			r.TimeReceived, err = f.string()
+		}
+		return
+	})
+}
+
+func WriteLibp2pMessage(w io.Writer, m *Libp2pMessage) error {
+	data := marshalProto(m)
+	frame := binary.AppendUvarint(nil, uint64(len(data)))
+	_, err := w.Write(append(frame, data...))
+	return err
+}
+
+func ReadLibp2pMessage(r *bufio.Reader) (*Libp2pMessage, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > MaxLibp2pMessage {
+		return nil, fmt.Errorf("Libp2p message of %d bytes too large", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	m := &Libp2pMessage{}
+	if err := m.unmarshalProto(data); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+/*
+ * Identifiers
+ * Peer IDs and provider keys are multihashes.  A NodeID travels as the sha1
+ * multihash of itself, anything else enters the keyspace by its SHA1 hash.
+ */
+
+// Multihash code and digest length of sha1
+const (
+	multihashSHA1 = 0x11
+	sha1Length    = 0x14
+)
+
+func Libp2pKey(id NodeID) []byte {
+	return append([]byte{multihashSHA1, sha1Length}, id[:]...)
+}
+
+func Libp2pNodeID(key []byte) NodeID {
+	if len(key) == IDLength+2 && key[0] == multihashSHA1 && key[1] == sha1Length {
+		var id NodeID
+		copy(id[:], key[2:])
+		return id
+	}
+
+	return NodeID(sha1.Sum(key))
+}
+
+func NewLibp2pPeer(contact Contact) Libp2pPeer {
+	peer := Libp2pPeer{ID: Libp2pKey(contact.ID)}
+	for _, address := range contact.Addresses() {
+		if addr, err := encodeMultiaddr(address); err == nil {
+			peer.Addrs = append(peer.Addrs, addr)
+		}
+	}
+
+	return peer
+}
+
+// The contact reached through the peer's first MaxAddresses supported
+// addresses
+func (p Libp2pPeer) Contact() (Contact, bool) {
+	addresses := []string{}
+	seen := make(map[string]struct{})
+	for _, addr := range p.Addrs {
+		address, err := decodeMultiaddr(addr)
+		if err != nil || ValidateAddress(address) != nil {
+			continue
+		}
+		if _, ok := seen[address]; ok {
+			continue
+		}
+		seen[address] = struct{}{}
+
+		addresses = append(addresses, address)
+		if len(addresses) == MaxAddresses {
+			break
+		}
+	}
+
+	contact, err := NewMultiContact(Libp2pNodeID(p.ID), addresses...)
+	return contact, err == nil
+}
+
+// Peers without a supported address are skipped
+func Libp2pContacts(peers []Libp2pPeer) Contacts {
+	contacts := Contacts{}
+	for _, peer := range peers {
+		if contact, ok := peer.Contact(); ok {
+			contacts = append(contacts, contact)
+		}
+	}
+
+	return contacts
+}
+
+// Multiaddr protocol codes
+const (
+	multiaddrIP4  = 4
+	multiaddrTCP  = 6
+	multiaddrIP6  = 41
+	multiaddrDNS  = 53
+	multiaddrDNS4 = 54
+	multiaddrDNS6 = 55
+)
+
+// Binary multiaddr for a host:port address, /ip4, /ip6 or /dns followed by
+// /tcp
+func encodeMultiaddr(address string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port in address %s", address)
+	}
+
+	var addr []byte
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		addr = append([]byte{multiaddrIP4}, ip.To4()...)
+	case ip != nil:
+		addr = append([]byte{multiaddrIP6}, ip...)
+	default:
+		addr = binary.AppendUvarint([]byte{multiaddrDNS}, uint64(len(host)))
+		addr = append(addr, host...)
+	}
+
+	addr = append(addr, multiaddrTCP)
+	return binary.BigEndian.AppendUint16(addr, uint16(port)), nil
+}
+
+// The host:port of a binary /ip4, /ip6 or /dns multiaddr followed by /tcp
+func decodeMultiaddr(addr []byte) (string, error) {
+	code, n := binary.Uvarint(addr)
+	if n <= 0 {
+		return "", errors.New("Truncated multiaddr")
+	}
+	addr = addr[n:]
+
+	var host string
+	switch code {
+	case multiaddrIP4, multiaddrIP6:
+		size := net.IPv4len
+		if code == multiaddrIP6 {
+			size = net.IPv6len
+		}
+		if len(addr) < size {
+			return "", errors.New("Truncated multiaddr")
+		}
+		host = net.IP(addr[:size]).String()
+		addr = addr[size:]
+	case multiaddrDNS, multiaddrDNS4, multiaddrDNS6:
+		length, n := binary.Uvarint(addr)
+		if n <= 0 || uint64(len(addr)-n) < length {
+			return "", errors.New("Truncated multiaddr")
+		}
+		host = string(addr[n : n+int(length)])
+		addr = addr[n+int(length):]
+	default:
+		return "", fmt.Errorf("Unsupported multiaddr protocol %d", code)
+	}
+
+	if len(addr) != 3 || addr[0] != multiaddrTCP {
+		return "", errors.New("Multiaddr is not a single TCP address")
+	}
+	port := binary.BigEndian.Uint16(addr[1:])
+
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+/*
+ * Libp2pStream
+ * Client side of a stream opened to a libp2p DHT peer under
+ * Libp2pProtocolID
+ */
+
+type Libp2pStream struct {
+	stream io.ReadWriter
+	reader *bufio.Reader
+}
+
+func NewLibp2pStream(stream io.ReadWriter) *Libp2pStream {
+	return &Libp2pStream{
+		stream: stream,
+		reader: bufio.NewReader(stream),
+	}
+}
+
+// Sends request and reads its response, ADD_PROVIDER has none
+func (s *Libp2pStream) Request(request *Libp2pMessage) (*Libp2pMessage, error) {
+	err := WriteLibp2pMessage(s.stream, request)
+	if err != nil || request.Type == Libp2pAddProvider {
+		return nil, err
+	}
+
+	response, err := ReadLibp2pMessage(s.reader)
+	if err != nil {
+		return nil, err
+	}
+	if response.Type != request.Type {
+		return nil, fmt.Errorf("Expected %s response, got %s", request.Type, response.Type)
+	}
+
+	return response, nil
+}
+
+// Returns the peers closest to key, Libp2pKey of a NodeID for node lookups
+func (s *Libp2pStream) FindNode(key []byte) (Contacts, error) {
+	response, err := s.Request(&Libp2pMessage{Type: Libp2pFindNode, Key: key})
+	if err != nil {
+		return nil, err
+	}
+
+	return Libp2pContacts(response.CloserPeers), nil
+}
+
+// Returns the record held under key, if any, and the closest peers
+func (s *Libp2pStream) GetValue(key []byte) (*Libp2pRecord, Contacts, error) {
+	response, err := s.Request(&Libp2pMessage{Type: Libp2pGetValue, Key: key})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return response.Record, Libp2pContacts(response.CloserPeers), nil
+}
+
+func (s *Libp2pStream) PutValue(key, value []byte) error {
+	_, err := s.Request(&Libp2pMessage{
+		Type:   Libp2pPutValue,
+		Key:    key,
+		Record: &Libp2pRecord{Key: key, Value: value},
+	})
+	return err
+}
+
+// Announces provider, which must be the authenticated sender, for key
+func (s *Libp2pStream) AddProvider(key []byte, provider Contact) error {
+	_, err := s.Request(&Libp2pMessage{
+		Type:          Libp2pAddProvider,
+		Key:           key,
+		ProviderPeers: []Libp2pPeer{NewLibp2pPeer(provider)},
+	})
+	return err
+}
+
+// Returns the providers of key and the closest peers
+func (s *Libp2pStream) GetProviders(key []byte) ([]Libp2pPeer, Contacts, error) {
+	response, err := s.Request(&Libp2pMessage{Type: Libp2pGetProviders, Key: key})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return response.ProviderPeers, Libp2pContacts(response.CloserPeers), nil
+}
+
+/*
+ * Serving
+ * Requests are answered from the node's routing table, values and providers
+ * databases.  libp2p peers cannot answer our own RPCs, so they never enter
+ * the routing table.
+ */
+
+// Answers requests on a stream accepted under Libp2pProtocolID until it is
+// closed.  remote is the peer authenticated by the libp2p host, its ID may be
+// empty when unknown.
+func (k *Kademlia) ServeLibp2p(stream io.ReadWriter, remote Libp2pPeer) error {
+	reader := bufio.NewReader(stream)
+	for {
+		request, err := ReadLibp2pMessage(reader)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		response, err := k.handleLibp2p(request, remote)
+		if err != nil {
+			return err
+		}
+		if response == nil {
+			continue
+		}
+
+		err = WriteLibp2pMessage(stream, response)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (k *Kademlia) handleLibp2p(request *Libp2pMessage, remote Libp2pPeer) (*Libp2pMessage,
+	error) {
+	response := &Libp2pMessage{
+		Type:            request.Type,
+		ClusterLevelRaw: request.ClusterLevelRaw,
+		Key:             request.Key,
+	}
+
+	switch request.Type {
+	case Libp2pPing:
+		return request, nil
+
+	case Libp2pFindNode:
+		response.Key = nil
+		response.CloserPeers = k.libp2pCloser(request.Key, remote)
+		return response, nil
+
+	case Libp2pGetValue:
+		err := k.requireCapability(CapRecords)
+		if err != nil {
+			return nil, err
+		}
+
+		record, err := k.getRecord(Libp2pNodeID(request.Key))
+		if err != nil {
+			log.Println(err)
+			return nil, errors.New("Read from values database failed")
+		}
+		if record != nil {
+			response.Record = &Libp2pRecord{Key: request.Key, Value: record.Value}
+		}
+		response.CloserPeers = k.libp2pCloser(request.Key, remote)
+		return response, nil
+
+	case Libp2pPutValue:
+		err := k.requireCapability(CapRecords)
+		if err != nil {
+			return nil, err
+		}
+
+		record := request.Record
+		if record == nil || string(record.Key) != string(request.Key) {
+			return nil, errors.New("PUT_VALUE record does not match its key")
+		}
+
+		err = k.putRecord(Libp2pNodeID(request.Key), NewValueRecord(record.Value),
+			storeOwner{ID: Libp2pNodeID(remote.ID), IP: libp2pRemoteIP(remote)})
+		if err != nil {
+			return nil, err
+		}
+		return request, nil
+
+	case Libp2pGetProviders:
+		err := k.requireCapability(CapProviders)
+		if err != nil {
+			return nil, err
+		}
+
+		records, _, err := k.getProviderRecords(Libp2pNodeID(request.Key), NodeID{},
+			ProviderPageSize)
+		if err != nil {
+			log.Println(err)
+			return nil, errors.New("Read from providers database failed")
+		}
+		for _, record := range records {
+			peer := NewLibp2pPeer(record.Provider)
+			if record.PeerID != nil {
+				peer.ID = record.PeerID
+			}
+			response.ProviderPeers = append(response.ProviderPeers, peer)
+		}
+		response.CloserPeers = k.libp2pCloser(request.Key, remote)
+		return response, nil
+
+	case Libp2pAddProvider:
+		err := k.requireCapability(CapProviders)
+		if err != nil {
+			return nil, err
+		}
+
+		// Peers may only announce themselves
+		for _, peer := range request.ProviderPeers {
+			if len(remote.ID) > 0 && string(peer.ID) != string(remote.ID) {
+				continue
+			}
+			contact, ok := peer.Contact()
+			if !ok {
+				continue
+			}
+
+			err = k.putProvider(Libp2pNodeID(request.Key), ProviderRecord{
+				Provider: contact,
+				Expires:  time.Now().Add(ProviderTTL),
+				PeerID:   peer.ID,
+			}, storeOwner{ID: Libp2pNodeID(remote.ID), IP: libp2pRemoteIP(remote)})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported libp2p message type %d", request.Type)
+}
+
+// The closest contacts to key other than the requester
+func (k *Kademlia) libp2pCloser(key []byte, remote Libp2pPeer) []Libp2pPeer {
+	remoteID := Libp2pNodeID(remote.ID)
+
+	peers := []Libp2pPeer{}
+	for _, contact := range k.routes.FindClosest(Libp2pNodeID(key), BucketSize) {
+		if len(remote.ID) > 0 && contact.ID == remoteID {
+			continue
+		}
+		peers = append(peers, NewLibp2pPeer(contact))
+	}
+
+	return peers
+}
+
+func libp2pRemoteIP(remote Libp2pPeer) string {
+	if contact, ok := remote.Contact(); ok {
+		host, _, _ := net.SplitHostPort(contact.Address)
+		return host
+	}
+	return ""
+}
@@ -0,0 +1,262 @@
+package kademlia
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Fixtures in testdata/libp2p are written by testdata/libp2p/gen with
+// go-libp2p-kad-dht v0.25.2's generated pb.Message, one length-prefixed
+// message per file
+
+func readFixture(t *testing.T, name string) []byte {
+	data, err := os.ReadFile(filepath.Join("testdata", "libp2p", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func decodeFixture(t *testing.T, name string) *Libp2pMessage {
+	m, err := ReadLibp2pMessage(bufio.NewReader(bytes.NewReader(readFixture(t, name))))
+	if err != nil {
+		t.Fatalf("Decoding %s failed: %s", name, err)
+	}
+	return m
+}
+
+func encodeLibp2p(m *Libp2pMessage) []byte {
+	var buffer bytes.Buffer
+	WriteLibp2pMessage(&buffer, m)
+	return buffer.Bytes()
+}
+
+func fixtureID(b byte) NodeID {
+	var id NodeID
+	for i := range id {
+		id[i] = b
+	}
+	return id
+}
+
+// The ed25519 identity peer ID used by the fixtures
+func fixturePeerID() []byte {
+	id := []byte{0x00, 0x24, 0x08, 0x01, 0x12, 0x20}
+	for i := 0; i < 32; i++ {
+		id = append(id, byte(i))
+	}
+	return id
+}
+
+var libp2pFixtures = []struct {
+	name string
+	kind Libp2pMessageType
+}{
+	{"ping.bin", Libp2pPing},
+	{"find_node_request.bin", Libp2pFindNode},
+	{"find_node_response.bin", Libp2pFindNode},
+	{"put_value_request.bin", Libp2pPutValue},
+	{"get_value_request.bin", Libp2pGetValue},
+	{"get_value_response.bin", Libp2pGetValue},
+	{"kad_dht_get_value_response.bin", Libp2pGetValue},
+	{"add_provider_request.bin", Libp2pAddProvider},
+	{"get_providers_request.bin", Libp2pGetProviders},
+	{"get_providers_response.bin", Libp2pGetProviders},
+}
+
+func TestLibp2pFixtures(t *testing.T) {
+	for _, tt := range libp2pFixtures {
+		m := decodeFixture(t, tt.name)
+		if m.Type != tt.kind {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.kind, m.Type)
+		}
+		if data := encodeLibp2p(m); !bytes.Equal(data, readFixture(t, tt.name)) {
+			t.Errorf("%s: re-encoded as\n% x", tt.name, data)
+		}
+	}
+
+	m := decodeFixture(t, "find_node_response.bin")
+	if len(m.Key) != 0 || len(m.CloserPeers) != 3 {
+		t.Fatalf("Unexpected find node response %+v", m)
+	}
+	if m.CloserPeers[0].Connection != Libp2pConnected ||
+		m.CloserPeers[1].Connection != Libp2pCanConnect {
+		t.Error("Connection types not decoded")
+	}
+
+	// The peer without addresses is not reachable
+	contacts := Libp2pContacts(m.CloserPeers)
+	multihomed, _ := NewMultiContact(NodeID(sha1.Sum(fixturePeerID())),
+		"example.com:4001", "[::1]:4002")
+	expected := Contacts{
+		NewContact(fixtureID(0x01), "10.0.0.1:4001"),
+		multihomed,
+	}
+	if contacts.Len() != expected.Len() {
+		t.Fatalf("Expected contacts %v, got %v", expected, contacts)
+	}
+	for i := range expected {
+		if contacts[i] != expected[i] {
+			t.Errorf("Expected contact %v, got %v", expected[i], contacts[i])
+		}
+	}
+
+	m = decodeFixture(t, "put_value_request.bin")
+	if m.Record == nil || string(m.Record.Value) != "hello libp2p" {
+		t.Errorf("Unexpected record %+v", m.Record)
+	}
+
+	// Fields go-libp2p-kad-dht nodes fill in themselves
+	m = decodeFixture(t, "kad_dht_get_value_response.bin")
+	if m.ClusterLevelRaw != 1 {
+		t.Errorf("Expected cluster level 1, got %d", m.ClusterLevelRaw)
+	}
+	if m.Record == nil || m.Record.TimeReceived != "2024-03-01T12:00:00.123456789Z" {
+		t.Errorf("Unexpected record %+v", m.Record)
+	}
+}
+
+var multiaddrTests = []struct {
+	address string
+	encoded []byte
+}{
+	{"10.0.0.1:4001", []byte{4, 10, 0, 0, 1, 6, 0x0f, 0xa1}},
+	{"[::1]:4002", append(append([]byte{41}, net.IPv6loopback...), 6, 0x0f, 0xa2)},
+	{"a.io:80", []byte{53, 4, 'a', '.', 'i', 'o', 6, 0, 80}},
+}
+
+func TestMultiaddrs(t *testing.T) {
+	for _, tt := range multiaddrTests {
+		encoded, err := encodeMultiaddr(tt.address)
+		if err != nil || !bytes.Equal(encoded, tt.encoded) {
+			t.Errorf("%s: encoded as % x, %v", tt.address, encoded, err)
+		}
+
+		address, err := decodeMultiaddr(tt.encoded)
+		if err != nil || address != tt.address {
+			t.Errorf("% x: decoded as %s, %v", tt.encoded, address, err)
+		}
+	}
+
+	// /ip4/10.0.0.1/udp/4001/quic
+	if _, err := decodeMultiaddr([]byte{4, 10, 0, 0, 1, 0x91, 0x02, 0x0f, 0xa1, 0xcc, 0x03}); err == nil {
+		t.Error("Non-TCP multiaddr should be rejected")
+	}
+
+	id := NewRandomNodeID()
+	if Libp2pNodeID(Libp2pKey(id)) != id {
+		t.Error("Node IDs should survive the libp2p key mapping")
+	}
+}
+
+// Serves kad over one end of a pipe, returning the other
+func serveLibp2pPipe(t *testing.T, kad *Kademlia, remote Libp2pPeer) net.Conn {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	go func() {
+		if err := kad.ServeLibp2p(server, remote); err != nil {
+			t.Log(err)
+		}
+		server.Close()
+	}()
+
+	return client
+}
+
+// Replays the recorded requests, expecting the recorded responses byte for
+// byte
+func TestServeLibp2pFixtures(t *testing.T) {
+	kad := newTestNode(t)
+	kad.routes.Update(NewContact(fixtureID(0x01), "10.0.0.1:4001"))
+
+	remote := decodeFixture(t, "add_provider_request.bin").ProviderPeers[0]
+	stream := serveLibp2pPipe(t, kad, remote)
+	reader := bufio.NewReader(stream)
+
+	exchanges := []struct {
+		request  string
+		response string
+	}{
+		{"ping.bin", "ping.bin"},
+		{"put_value_request.bin", "put_value_request.bin"},
+		{"get_value_request.bin", "get_value_response.bin"},
+		{"add_provider_request.bin", ""},
+		{"get_providers_request.bin", "get_providers_response.bin"},
+	}
+
+	for _, exchange := range exchanges {
+		if _, err := stream.Write(readFixture(t, exchange.request)); err != nil {
+			t.Fatal(err)
+		}
+		if exchange.response == "" {
+			continue
+		}
+
+		response, err := ReadLibp2pMessage(reader)
+		if err != nil {
+			t.Fatalf("%s: %s", exchange.request, err)
+		}
+		if data := encodeLibp2p(response); !bytes.Equal(data, readFixture(t, exchange.response)) {
+			t.Errorf("%s: expected %s, got\n% x", exchange.request, exchange.response, data)
+		}
+	}
+}
+
+func TestLibp2pStream(t *testing.T) {
+	kad := newTestNode(t)
+	self := kad.routes.Self()
+	closest := NewContact(NewRandomNodeID(), "10.0.0.2:4001")
+	kad.routes.Update(closest)
+
+	provider := NewContact(NewRandomNodeID(), "[2001:db8::1]:4001")
+	stream := NewLibp2pStream(serveLibp2pPipe(t, kad, NewLibp2pPeer(provider)))
+
+	contacts, err := stream.FindNode(Libp2pKey(self.ID))
+	if err != nil || contacts.Len() != 2 || contacts[0] != self {
+		t.Errorf("Find node returned %v, %v", contacts, err)
+	}
+
+	key := []byte("/v/key")
+	if err := stream.PutValue(key, []byte("value")); err != nil {
+		t.Fatal("Put value failed:", err)
+	}
+	record, _, err := stream.GetValue(key)
+	if err != nil || record == nil || string(record.Value) != "value" {
+		t.Errorf("Get value returned %+v, %v", record, err)
+	}
+
+	// Values are stored under the hash of their key
+	stored, err := kad.getRecord(Libp2pNodeID(key))
+	if err != nil || stored == nil || string(stored.Value) != "value" {
+		t.Errorf("Value not stored under its Node ID: %+v, %v", stored, err)
+	}
+
+	content := Libp2pKey(NewRandomNodeID())
+	if err := stream.AddProvider(content, provider); err != nil {
+		t.Fatal(err)
+	}
+	// Announcements on behalf of other peers are ignored
+	if err := stream.AddProvider(content, closest); err != nil {
+		t.Fatal(err)
+	}
+
+	providers, closer, err := stream.GetProviders(content)
+	if err != nil || len(providers) != 1 || closer.Len() != 1 {
+		t.Fatalf("Get providers returned %v, %v, %v", providers, closer, err)
+	}
+	if contact, ok := providers[0].Contact(); !ok || contact != provider {
+		t.Errorf("Expected provider %v, got %v", provider, contact)
+	}
+
+	// Providers are shared with the native protocol
+	found, _, err := kad.getProviders(Libp2pNodeID(content), NodeID{}, ProviderPageSize)
+	if err != nil || found.Len() != 1 || found[0] != provider {
+		t.Errorf("Expected native provider %v, got %v, %v", provider, found, err)
+	}
+}
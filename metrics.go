@@ -0,0 +1,166 @@
+package kademlia
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// Consecutive failed RPCs after which a contact is marked stale
+	StaleFailures = 3
+	// Consecutive failed RPCs after which a contact is removed even when
+	// nothing is waiting to replace it
+	MaxFailures = 5
+	// Contacts kept per bucket to replace ones that go stale
+	ReplacementCacheSize = BucketSize
+	// Weight given to each new round trip sample
+	RTTSmoothing = 0.125
+)
+
+// Liveness and quality of a contact as observed by the routing table
+type ContactMetrics struct {
+	LastSeen time.Time
+	// Exponentially weighted moving average, zero until the first success
+	RTT       time.Duration
+	Failures  int
+	Successes int
+	Stale     bool
+	// Protocol version and capabilities last advertised
+	Version      uint32
+	Capabilities Capabilities
+}
+
+func (rt *RoutingTable) Metrics(id NodeID) (ContactMetrics, bool) {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	metrics, ok := rt.metrics[id]
+	if !ok {
+		return ContactMetrics{}, false
+	}
+
+	return *metrics, true
+}
+
+// Records a successful RPC to a contact in the table
+func (rt *RoutingTable) RecordSuccess(id NodeID, rtt time.Duration) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	metrics, ok := rt.metrics[id]
+	if !ok {
+		return
+	}
+
+	if metrics.Successes == 0 {
+		metrics.RTT = rtt
+	} else {
+		metrics.RTT += time.Duration(RTTSmoothing * float64(rtt-metrics.RTT))
+	}
+	metrics.Successes++
+	metrics.Failures = 0
+	metrics.Stale = false
+	metrics.LastSeen = time.Now()
+}
+
+// Records a failed RPC to a contact in the table.  Stale contacts are
+// replaced once a replacement is cached, and removed regardless after
+// RemoveAfter failures.
+func (rt *RoutingTable) RecordFailure(id NodeID) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	metrics, ok := rt.metrics[id]
+	if !ok {
+		return
+	}
+
+	metrics.Failures++
+	if metrics.Failures >= rt.staleAfter() {
+		metrics.Stale = true
+	}
+
+	bucket := rt.kbuckets[rt.bucketIndex(id)]
+	if metrics.Failures >= rt.removeAfter() ||
+		metrics.Stale && len(bucket.replacements) > 0 {
+		rt.evict(id)
+	}
+}
+
+func (rt *RoutingTable) staleAfter() int {
+	if rt.config.StaleAfter > 0 {
+		return rt.config.StaleAfter
+	}
+
+	return StaleFailures
+}
+
+func (rt *RoutingTable) removeAfter() int {
+	if rt.config.RemoveAfter > 0 {
+		return rt.config.RemoveAfter
+	}
+
+	return MaxFailures
+}
+
+// Hearing from a contact shows it is alive
+func (rt *RoutingTable) seen(id NodeID, at time.Time) {
+	metrics, ok := rt.metrics[id]
+	if !ok {
+		metrics = &ContactMetrics{}
+		rt.metrics[id] = metrics
+	}
+
+	metrics.LastSeen = at
+	metrics.Failures = 0
+	metrics.Stale = false
+}
+
+// Ranks contacts by distance class from target, the length of the prefix
+// they share with it.  Within a class, live contacts come before stale ones,
+// then by measured latency with unmeasured contacts last, then by distance.
+// Callers choose which contacts to rank, so that latency never decides which
+// contacts count as closest.
+func (rt *RoutingTable) rank(contacts Contacts, target NodeID) {
+	quality := func(id NodeID) (bool, time.Duration) {
+		metrics, ok := rt.metrics[id]
+		if !ok || metrics.Successes == 0 {
+			return ok && metrics.Stale, time.Duration(math.MaxInt64)
+		}
+		return metrics.Stale, metrics.RTT
+	}
+
+	sort.SliceStable(contacts, func(i, j int) bool {
+		di := contacts[i].ID.Xor(target)
+		dj := contacts[j].ID.Xor(target)
+		if ci, cj := di.leadingZeros(), dj.leadingZeros(); ci != cj {
+			return ci > cj
+		}
+
+		si, ri := quality(contacts[i].ID)
+		sj, rj := quality(contacts[j].ID)
+		if si != sj {
+			return !si
+		}
+		if ri != rj {
+			return ri < rj
+		}
+
+		return di.Less(dj)
+	})
+}
+
+// Orders contacts by distance from target, then ranks the BucketSize closest
+// so that lookups query preferred peers among them first
+func (rt *RoutingTable) Order(contacts Contacts, target NodeID) {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	contacts.SortByDistance(target)
+	if contacts.Len() > BucketSize {
+		rt.rank(contacts[:BucketSize], target)
+	} else {
+		rt.rank(contacts, target)
+	}
+}
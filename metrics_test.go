@@ -0,0 +1,230 @@
+package kademlia
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRecordSuccessAveragesRTT(t *testing.T) {
+	table := NewRoutingTable(selfContact)
+	contact := NewContact(NewRandomNodeID(), "127.0.0.1:6001")
+	table.Update(contact)
+
+	table.RecordSuccess(contact.ID, 100*time.Millisecond)
+	table.RecordSuccess(contact.ID, 20*time.Millisecond)
+
+	metrics, ok := table.Metrics(contact.ID)
+	if !ok {
+		t.Fatal("Metrics missing for contact in the table")
+	}
+	if metrics.Successes != 2 {
+		t.Errorf("Expected 2 successes, got %d", metrics.Successes)
+	}
+	if metrics.RTT != 90*time.Millisecond {
+		t.Errorf("Expected RTT of 90ms, got %v", metrics.RTT)
+	}
+
+	if _, ok := table.Metrics(NewRandomNodeID()); ok {
+		t.Error("Unknown contacts should have no metrics")
+	}
+}
+
+func TestConsecutiveFailuresMarkStale(t *testing.T) {
+	table := NewRoutingTableWithConfig(selfContact, RoutingConfig{StaleAfter: 2})
+	contact := NewContact(NewRandomNodeID(), "127.0.0.1:6001")
+	table.Update(contact)
+
+	table.RecordFailure(contact.ID)
+	if metrics, _ := table.Metrics(contact.ID); metrics.Stale {
+		t.Error("Contact should not be stale after a single failure")
+	}
+
+	table.RecordFailure(contact.ID)
+	if metrics, _ := table.Metrics(contact.ID); !metrics.Stale || metrics.Failures != 2 {
+		t.Errorf("Expected stale contact with 2 failures, got %+v", metrics)
+	}
+
+	table.Update(contact)
+	if metrics, _ := table.Metrics(contact.ID); metrics.Stale || metrics.Failures != 0 {
+		t.Errorf("Hearing from a contact should clear failures, got %+v", metrics)
+	}
+}
+
+func TestFindClosestPrefersLowLatency(t *testing.T) {
+	table := NewRoutingTable(selfContact)
+	target := NewRandomNodeID()
+
+	// Both contacts share exactly 8 bits with the target
+	slow, fast := target, target
+	slow.flipBit(8)
+	fast.flipBit(8)
+	fast.flipBit(9)
+
+	table.Update(NewContact(slow, "127.0.0.1:6001"))
+	table.Update(NewContact(fast, "127.0.0.1:6002"))
+	table.RecordSuccess(slow, 200*time.Millisecond)
+	table.RecordSuccess(fast, 10*time.Millisecond)
+
+	closest := table.FindClosest(target, 2)
+	if closest.Len() != 2 || closest[0].ID != fast {
+		t.Error("Lower latency contact should be preferred within a distance class")
+	}
+
+	table.RecordFailure(fast)
+	table.RecordFailure(fast)
+	table.RecordFailure(fast)
+	closest = table.FindClosest(target, 2)
+	if closest.Len() != 2 || closest[0].ID != slow {
+		t.Error("Stale contacts should come after live ones")
+	}
+}
+
+func TestFindClosestOrdersByDistance(t *testing.T) {
+	table := NewRoutingTable(selfContact)
+	target := NewRandomNodeID()
+
+	// Both contacts share exactly 8 bits with the target
+	near, far := target, target
+	near.flipBit(8)
+	far.flipBit(8)
+	far.flipBit(9)
+
+	table.Update(NewContact(near, "127.0.0.1:6001"))
+	table.Update(NewContact(far, "127.0.0.1:6002"))
+	table.RecordSuccess(near, 200*time.Millisecond)
+	table.RecordSuccess(far, 10*time.Millisecond)
+
+	closest := table.FindClosest(target, 1)
+	if closest.Len() != 1 || closest[0].ID != near {
+		t.Error("Latency should not decide which contacts are closest")
+	}
+}
+
+func TestCallRecordsMetrics(t *testing.T) {
+	server := newTestNode(t)
+	client := newTestNode(t)
+
+	if err := client.Ping(server.routes.Self()); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, ok := client.routes.Metrics(server.routes.Self().ID)
+	if !ok || metrics.Successes != 1 || metrics.RTT <= 0 {
+		t.Errorf("Expected a measured success, got %+v", metrics)
+	}
+
+	server.Close()
+	client.Ping(server.routes.Self())
+
+	metrics, _ = client.routes.Metrics(server.routes.Self().ID)
+	if metrics.Failures != 1 {
+		t.Errorf("Expected 1 failure, got %d", metrics.Failures)
+	}
+}
+
+// A contact in the half of the ID space not covering self, whose bucket
+// never splits
+func farContact(port int) Contact {
+	id := NewRandomNodeID()
+	if id.bit(0) == selfID.bit(0) {
+		id.flipBit(0)
+	}
+
+	return NewContact(id, fmt.Sprintf("127.0.0.1:%d", port))
+}
+
+func fullFarBucket(config RoutingConfig) (*RoutingTable, Contacts) {
+	table := NewRoutingTableWithConfig(selfContact, config)
+
+	contacts := Contacts{}
+	for i := 0; i < BucketSize; i++ {
+		contact := farContact(7000 + i)
+		table.Update(contact)
+		contacts = append(contacts, contact)
+	}
+
+	return table, contacts
+}
+
+func TestFailuresRemoveContact(t *testing.T) {
+	table := NewRoutingTableWithConfig(selfContact, RoutingConfig{RemoveAfter: 2})
+	contact := NewContact(NewRandomNodeID(), "127.0.0.1:6001")
+	table.Update(contact)
+
+	table.RecordFailure(contact.ID)
+	if !table.contains(contact.ID) {
+		t.Fatal("Contact removed before reaching the threshold")
+	}
+
+	table.RecordFailure(contact.ID)
+	if table.contains(contact.ID) {
+		t.Error("Contact should be removed after reaching the threshold")
+	}
+	if _, ok := table.Metrics(contact.ID); ok {
+		t.Error("Metrics should be dropped with the contact")
+	}
+}
+
+func TestStaleContactReplacedFromCache(t *testing.T) {
+	table, contacts := fullFarBucket(RoutingConfig{StaleAfter: 1})
+
+	older, newer := farContact(8000), farContact(8001)
+	table.Update(older)
+	table.Update(newer)
+	if table.contains(older.ID) || table.contains(newer.ID) {
+		t.Fatal("Full bucket should not admit newcomers while its contacts are live")
+	}
+
+	table.RecordFailure(contacts[0].ID)
+	if table.contains(contacts[0].ID) {
+		t.Error("Stale contact should be replaced")
+	}
+	if !table.contains(newer.ID) || table.contains(older.ID) {
+		t.Error("Most recently seen replacement should be promoted")
+	}
+}
+
+func TestNewcomerReplacesStaleContact(t *testing.T) {
+	table, contacts := fullFarBucket(RoutingConfig{StaleAfter: 1})
+	table.RecordFailure(contacts[3].ID)
+
+	newcomer := farContact(8000)
+	table.Update(newcomer)
+	if !table.contains(newcomer.ID) || table.contains(contacts[3].ID) {
+		t.Error("Newcomer should take the place of the stale contact")
+	}
+}
+
+func TestRemovePromotesReplacement(t *testing.T) {
+	table, contacts := fullFarBucket(RoutingConfig{})
+	replacement := farContact(8000)
+	table.Update(replacement)
+
+	table.Remove(contacts[5].ID)
+	if table.contains(contacts[5].ID) || !table.contains(replacement.ID) {
+		t.Error("Removed contact should be replaced from the cache")
+	}
+
+	table.Remove(replacement.ID)
+	if n := len(table.SeenContacts()); n != BucketSize-1 {
+		t.Errorf("Expected %d contacts, got %d", BucketSize-1, n)
+	}
+}
+
+func TestUnreachableContactRemoved(t *testing.T) {
+	server := newTestNode(t)
+	client := newTestNode(t)
+	dead := server.routes.Self()
+
+	client.routes.Update(dead)
+	server.Close()
+
+	for i := 0; i < MaxFailures; i++ {
+		client.Ping(dead)
+	}
+
+	if client.routes.contains(dead.ID) {
+		t.Error("Unreachable contact should be removed after repeated failures")
+	}
+}
@@ -1,8 +1,12 @@
 package kademlia
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha1"
 	"encoding/hex"
+	"errors"
+	"fmt"
 )
 
 type NodeID [IDLength]byte
@@ -15,6 +19,19 @@ func NewNodeID(data string) (ret NodeID) {
 	return
 }
 
+func ParseNodeID(data string) (ret NodeID, err error) {
+	decoded, err := hex.DecodeString(data)
+	if err != nil {
+		return ret, err
+	}
+	if len(decoded) != IDLength {
+		return ret, fmt.Errorf("Node ID must be %d bytes, got %d", IDLength, len(decoded))
+	}
+
+	copy(ret[:], decoded)
+	return ret, nil
+}
+
 func NewRandomNodeID() (ret NodeID) {
 	buffer := make([]byte, IDLength)
 	_, err := rand.Read(buffer)
@@ -27,6 +44,132 @@ func NewRandomNodeID() (ret NodeID) {
 	return
 }
 
+/*
+ * S/Kademlia crypto puzzles
+ *
+ * A node's ID is the hash of its public key.  The static puzzle requires the
+ * first Static bits of H(ID) to be zero, which makes choosing an ID expensive.
+ * The dynamic puzzle requires a nonce X such that the first Dynamic bits of
+ * H(ID xor X) are zero, which makes generating many IDs expensive.
+ *
+ * Headers carry the public key and nonce, which anyone may copy.  Possession
+ * of the key is proven only by the TLS transport, whose handshake binds each
+ * connection to the ID derived from the remote's key.  Over plain TCP the
+ * puzzles still make new IDs expensive, but a peer can claim the ID of any
+ * node whose header it has seen.
+ */
+
+type Difficulty struct {
+	Static  int
+	Dynamic int
+}
+
+type Identity struct {
+	ID         NodeID
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+	Nonce      NodeID
+}
+
+func NewIdentity(difficulty Difficulty) (*Identity, error) {
+	var (
+		public  ed25519.PublicKey
+		private ed25519.PrivateKey
+		id      NodeID
+		err     error
+	)
+
+	for {
+		public, private, err = ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		id = NodeIDFromPublicKey(public)
+		if solvesStaticPuzzle(id, difficulty.Static) {
+			break
+		}
+	}
+
+	return &Identity{
+		ID:         id,
+		PublicKey:  public,
+		PrivateKey: private,
+		Nonce:      SolveDynamicPuzzle(id, difficulty.Dynamic),
+	}, nil
+}
+
+func NodeIDFromPublicKey(key ed25519.PublicKey) NodeID {
+	return NodeID(sha1.Sum(key))
+}
+
+func SolveDynamicPuzzle(id NodeID, difficulty int) NodeID {
+	nonce := NewRandomNodeID()
+	for !solvesDynamicPuzzle(id, nonce, difficulty) {
+		nonce.increment()
+	}
+
+	return nonce
+}
+
+// Checks that id derives from key and solves the puzzles.  This does not show
+// that the sender holds the key, see above.
+func VerifyPuzzle(id NodeID, key ed25519.PublicKey, nonce NodeID,
+	difficulty Difficulty) error {
+	if difficulty.Static <= 0 && difficulty.Dynamic <= 0 {
+		return nil
+	}
+
+	if len(key) != ed25519.PublicKeySize {
+		return errors.New("Missing or malformed public key")
+	}
+	if NodeIDFromPublicKey(key) != id {
+		return fmt.Errorf("Node ID %s does not match public key", id)
+	}
+	if !solvesStaticPuzzle(id, difficulty.Static) {
+		return fmt.Errorf("Node ID %s does not solve static puzzle", id)
+	}
+	if !solvesDynamicPuzzle(id, nonce, difficulty.Dynamic) {
+		return fmt.Errorf("Nonce %s does not solve dynamic puzzle", nonce)
+	}
+
+	return nil
+}
+
+func solvesStaticPuzzle(id NodeID, difficulty int) bool {
+	return NodeID(sha1.Sum(id[:])).leadingZeros() >= difficulty
+}
+
+func solvesDynamicPuzzle(id, nonce NodeID, difficulty int) bool {
+	distance := id.Xor(nonce)
+	return NodeID(sha1.Sum(distance[:])).leadingZeros() >= difficulty
+}
+
+func (node NodeID) leadingZeros() int {
+	zeros := node.PrefixLen(NodeID{})
+	if zeros == -1 {
+		return IDBytesLength
+	}
+	return zeros
+}
+
+func (node NodeID) bit(i int) byte {
+	return (node[i/8] >> uint(7-i%8)) & 0x1
+}
+
+func (node *NodeID) flipBit(i int) {
+	node[i/8] ^= 0x80 >> uint(i%8)
+}
+
+func (node *NodeID) increment() {
+	for i := IDLength - 1; i >= 0; i-- {
+		node[i]++
+		if node[i] != 0 {
+			return
+		}
+	}
+}
+
 func (node NodeID) String() string {
 	return hex.EncodeToString(node[0:IDLength])
 }
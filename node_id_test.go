@@ -132,3 +132,46 @@ func TestPrefixLen(t *testing.T) {
 		}
 	}
 }
+
+var puzzleDifficulty = Difficulty{Static: 4, Dynamic: 4}
+
+func TestNewIdentitySolvesPuzzles(t *testing.T) {
+	identity, err := NewIdentity(puzzleDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if identity.ID != NodeIDFromPublicKey(identity.PublicKey) {
+		t.Error("Identity ID should be the hash of its public key")
+	}
+
+	err = VerifyPuzzle(identity.ID, identity.PublicKey, identity.Nonce, puzzleDifficulty)
+	if err != nil {
+		t.Error("Generated identity should solve its own puzzles:", err)
+	}
+}
+
+func TestVerifyPuzzleRejects(t *testing.T) {
+	identity, err := NewIdentity(puzzleDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if VerifyPuzzle(NewRandomNodeID(), identity.PublicKey, identity.Nonce, puzzleDifficulty) == nil {
+		t.Error("Node ID not derived from the public key should be rejected")
+	}
+	if VerifyPuzzle(identity.ID, nil, identity.Nonce, puzzleDifficulty) == nil {
+		t.Error("Missing public key should be rejected")
+	}
+
+	harder := Difficulty{Static: puzzleDifficulty.Static, Dynamic: IDBytesLength}
+	if VerifyPuzzle(identity.ID, identity.PublicKey, identity.Nonce, harder) == nil {
+		t.Error("Nonce should not solve an unreachable dynamic difficulty")
+	}
+}
+
+func TestVerifyPuzzleDisabled(t *testing.T) {
+	if VerifyPuzzle(NewRandomNodeID(), nil, NodeID{}, Difficulty{}) != nil {
+		t.Error("Zero difficulty should accept any contact")
+	}
+}
@@ -6,10 +6,7 @@ type PingRequest struct {
 
 func (k *Kademlia) NewPingRequest() PingRequest {
 	return PingRequest{
-		RPCHeader{
-			Sender:    k.routes.self,
-			NetworkID: k.NetworkID,
-		},
+		k.newRPCHeader(),
 	}
 }
 
@@ -18,17 +15,30 @@ type PingResponse struct {
 }
 
 func (k *Kademlia) Ping(target Contact) error {
-	client, err := dialContact(target)
-	if err != nil {
-		return err
-	}
+	_, err := k.ping(target)
+	return err
+}
+
+// Learns the NodeID of whoever listens at address
+func (k *Kademlia) Identify(address string) (Contact, error) {
+	return k.ping(NewContact(NodeID{}, address))
+}
 
+func (k *Kademlia) ping(target Contact) (Contact, error) {
 	req := k.NewPingRequest()
 	res := PingResponse{}
 
-	return client.Call("KademliaCore.PingRPC", &req, &res)
+	err := k.call(target, "KademliaCore.PingRPC", &req, &res)
+	if err != nil {
+		return Contact{}, err
+	}
+
+	identified := target
+	identified.ID = res.Sender.ID
+
+	return identified, nil
 }
 
 func (kc *KademliaCore) PingRPC(req PingRequest, res *PingResponse) error {
-	return kc.kad.HandleRPC(req.RPCHeader, &res.RPCHeader)
+	return kc.handleRPC(req.RPCHeader, &res.RPCHeader)
 }
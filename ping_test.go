@@ -0,0 +1,32 @@
+package kademlia
+
+import (
+	"context"
+	"testing"
+)
+
+func TestIdentify(t *testing.T) {
+	server := newTestNode(t)
+	client := newTestNode(t)
+
+	contact, err := client.Identify(server.routes.Self().Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contact != server.routes.Self() {
+		t.Errorf("Expected to learn %s, got %s", server.routes.Self().ID, contact.ID)
+	}
+}
+
+func TestJoinByAddressOnly(t *testing.T) {
+	seed := newTestNode(t)
+	joiner := newTestNode(t)
+
+	err := joiner.Join(context.Background(), NewContact(NodeID{}, seed.routes.Self().Address))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joiner.routes.FindClosest(seed.routes.Self().ID, 1)[0] != seed.routes.Self() {
+		t.Error("Seed bootstrapped by address should be in the routing table")
+	}
+}
@@ -0,0 +1,698 @@
+package kademlia
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"time"
+)
+
+const (
+	// Version of the schema in kademlia.proto carried by every envelope
+	ProtoVersion = 1
+	// Largest envelope accepted from a peer
+	MaxProtoMessage = 1 << 20
+)
+
+// Protobuf wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var (
+	errProtoTruncated = errors.New("Truncated protobuf message")
+	errProtoWireType  = errors.New("Unexpected protobuf wire type")
+)
+
+type protoMessage interface {
+	marshalProto(e *protoEncoder)
+	unmarshalProto(data []byte) error
+}
+
+func marshalProto(m protoMessage) []byte {
+	e := &protoEncoder{}
+	m.marshalProto(e)
+	return e.buf
+}
+
+/*
+ * protoEncoder
+ * Appends fields in the protobuf wire format, omitting proto3 defaults
+ */
+
+type protoEncoder struct {
+	buf []byte
+}
+
+func (e *protoEncoder) tag(field, wire int) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(field<<3|wire))
+}
+
+func (e *protoEncoder) uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, protoVarint)
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *protoEncoder) int(field int, v int64) {
+	e.uint(field, uint64(v))
+}
+
+func (e *protoEncoder) bool(field int, v bool) {
+	if v {
+		e.uint(field, 1)
+	}
+}
+
+func (e *protoEncoder) bytes(field int, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	e.tag(field, protoBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *protoEncoder) string(field int, v string) {
+	e.bytes(field, []byte(v))
+}
+
+func (e *protoEncoder) id(field int, id NodeID) {
+	if id != (NodeID{}) {
+		e.bytes(field, id[:])
+	}
+}
+
+// Embedded messages are written even when empty so their presence survives
+func (e *protoEncoder) message(field int, m protoMessage) {
+	inner := marshalProto(m)
+	e.tag(field, protoBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(inner)))
+	e.buf = append(e.buf, inner...)
+}
+
+func (e *protoEncoder) contacts(field int, contacts Contacts) {
+	for i := range contacts {
+		e.message(field, &contacts[i])
+	}
+}
+
+/*
+ * protoField
+ * A single decoded field, unknown fields are skipped by their wire type
+ */
+
+type protoField struct {
+	num    int
+	wire   int
+	varint uint64
+	bytes  []byte
+}
+
+func decodeProto(data []byte, visit func(f protoField) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		data = data[n:]
+
+		f := protoField{num: int(key >> 3), wire: int(key & 7)}
+		switch f.wire {
+		case protoVarint:
+			f.varint, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errProtoTruncated
+			}
+			data = data[n:]
+		case protoBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errProtoTruncated
+			}
+			f.bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case protoFixed64, protoFixed32:
+			size := 8
+			if f.wire == protoFixed32 {
+				size = 4
+			}
+			if len(data) < size {
+				return errProtoTruncated
+			}
+			data = data[size:]
+		default:
+			return errProtoWireType
+		}
+
+		if err := visit(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f protoField) uint() (uint64, error) {
+	if f.wire != protoVarint {
+		return 0, errProtoWireType
+	}
+	return f.varint, nil
+}
+
+func (f protoField) int() (int64, error) {
+	v, err := f.uint()
+	return int64(v), err
+}
+
+func (f protoField) bool() (bool, error) {
+	v, err := f.uint()
+	return v != 0, err
+}
+
+func (f protoField) data() ([]byte, error) {
+	if f.wire != protoBytes {
+		return nil, errProtoWireType
+	}
+	return append([]byte{}, f.bytes...), nil
+}
+
+func (f protoField) string() (string, error) {
+	if f.wire != protoBytes {
+		return "", errProtoWireType
+	}
+	return string(f.bytes), nil
+}
+
+func (f protoField) id() (id NodeID, err error) {
+	if f.wire != protoBytes {
+		return id, errProtoWireType
+	}
+	if len(f.bytes) != IDLength {
+		return id, fmt.Errorf("Expected %d byte Node ID, got %d", IDLength, len(f.bytes))
+	}
+
+	copy(id[:], f.bytes)
+	return id, nil
+}
+
+func (f protoField) message(m protoMessage) error {
+	if f.wire != protoBytes {
+		return errProtoWireType
+	}
+	return m.unmarshalProto(f.bytes)
+}
+
+func (f protoField) contact(contacts *Contacts) error {
+	contact := Contact{}
+	if err := f.message(&contact); err != nil {
+		return err
+	}
+
+	*contacts = append(*contacts, contact)
+	return nil
+}
+
+/*
+ * Messages
+ * Field numbers follow kademlia.proto
+ */
+
+func (c *Contact) marshalProto(e *protoEncoder) {
+	e.id(1, c.ID)
+	e.string(2, c.Address)
+	for _, address := range c.Alternates {
+		if address != "" {
+			e.string(3, address)
+		}
+	}
+}
+
+func (c *Contact) unmarshalProto(data []byte) error {
+	alternates := 0
+	return decodeProto(data, func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			c.ID, err = f.id()
+		case 2:
+			c.Address, err = f.string()
+		case 3:
+			if alternates == len(c.Alternates) {
+				return fmt.Errorf("Contact has more than %d addresses", MaxAddresses)
+			}
+			c.Alternates[alternates], err = f.string()
+			alternates++
+		}
+		return
+	})
+}
+
+func (h *RPCHeader) marshalProto(e *protoEncoder) {
+	e.message(1, &h.Sender)
+	e.string(2, h.NetworkID)
+	e.bytes(3, h.PublicKey)
+	e.id(4, h.Nonce)
+	e.uint(5, uint64(h.Version))
+	e.uint(6, uint64(h.MinVersion))
+	e.uint(7, uint64(h.Capabilities))
+}
+
+func (h *RPCHeader) unmarshalProto(data []byte) error {
+	return decodeProto(data, func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			err = f.message(&h.Sender)
+		case 2:
+			h.NetworkID, err = f.string()
+		case 3:
+			h.PublicKey, err = f.data()
+		case 4:
+			h.Nonce, err = f.id()
+		case 5:
+			var version uint64
+			version, err = f.uint()
+			h.Version = uint32(version)
+		case 6:
+			var version uint64
+			version, err = f.uint()
+			h.MinVersion = uint32(version)
+		case 7:
+			var capabilities uint64
+			capabilities, err = f.uint()
+			h.Capabilities = Capabilities(capabilities)
+		}
+		return
+	})
+}
+
+func (r *Record) marshalProto(e *protoEncoder) {
+	e.uint(1, uint64(r.Kind))
+	e.bytes(2, r.Value)
+	e.bytes(3, r.PublicKey)
+	e.bytes(4, r.Salt)
+	e.int(5, r.Seq)
+	e.bytes(6, r.Signature)
+}
+
+func (r *Record) unmarshalProto(data []byte) error {
+	return decodeProto(data, func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			var kind uint64
+			kind, err = f.uint()
+			r.Kind = RecordKind(kind)
+		case 2:
+			r.Value, err = f.data()
+		case 3:
+			r.PublicKey, err = f.data()
+		case 4:
+			r.Salt, err = f.data()
+		case 5:
+			r.Seq, err = f.int()
+		case 6:
+			r.Signature, err = f.data()
+		}
+		return
+	})
+}
+
+// Messages carrying nothing but the header
+func marshalHeaderOnly(e *protoEncoder, h *RPCHeader) {
+	e.message(1, h)
+}
+
+func unmarshalHeaderOnly(data []byte, h *RPCHeader) error {
+	return decodeProto(data, func(f protoField) error {
+		if f.num == 1 {
+			return f.message(h)
+		}
+		return nil
+	})
+}
+
+func (m *PingRequest) marshalProto(e *protoEncoder) {
+	marshalHeaderOnly(e, &m.RPCHeader)
+}
+
+func (m *PingResponse) marshalProto(e *protoEncoder) {
+	marshalHeaderOnly(e, &m.RPCHeader)
+}
+
+func (m *StoreResponse) marshalProto(e *protoEncoder) {
+	marshalHeaderOnly(e, &m.RPCHeader)
+}
+
+func (m *AddProviderResponse) marshalProto(e *protoEncoder) {
+	marshalHeaderOnly(e, &m.RPCHeader)
+}
+
+func (m *PingRequest) unmarshalProto(data []byte) error {
+	return unmarshalHeaderOnly(data, &m.RPCHeader)
+}
+
+func (m *PingResponse) unmarshalProto(data []byte) error {
+	return unmarshalHeaderOnly(data, &m.RPCHeader)
+}
+
+func (m *StoreResponse) unmarshalProto(data []byte) error {
+	return unmarshalHeaderOnly(data, &m.RPCHeader)
+}
+
+func (m *AddProviderResponse) unmarshalProto(data []byte) error {
+	return unmarshalHeaderOnly(data, &m.RPCHeader)
+}
+
+func (m *FindNodeRequest) marshalProto(e *protoEncoder) {
+	e.message(1, &m.RPCHeader)
+	e.id(2, m.Target)
+}
+
+func (m *FindNodeRequest) unmarshalProto(data []byte) error {
+	return decodeProto(data, func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			err = f.message(&m.RPCHeader)
+		case 2:
+			m.Target, err = f.id()
+		}
+		return
+	})
+}
+
+func (m *FindNodeResponse) marshalProto(e *protoEncoder) {
+	e.message(1, &m.RPCHeader)
+	e.contacts(2, m.Contacts)
+}
+
+func (m *FindNodeResponse) unmarshalProto(data []byte) error {
+	return decodeProto(data, func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			err = f.message(&m.RPCHeader)
+		case 2:
+			err = f.contact(&m.Contacts)
+		}
+		return
+	})
+}
+
+func (m *FindValueRequest) marshalProto(e *protoEncoder) {
+	e.message(1, &m.RPCHeader)
+	e.id(2, m.Target)
+	e.id(3, m.ProvidersAfter)
+}
+
+func (m *FindValueRequest) unmarshalProto(data []byte) error {
+	return decodeProto(data, func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			err = f.message(&m.RPCHeader)
+		case 2:
+			m.Target, err = f.id()
+		case 3:
+			m.ProvidersAfter, err = f.id()
+		}
+		return
+	})
+}
+
+func (m *FindValueResponse) marshalProto(e *protoEncoder) {
+	e.message(1, &m.RPCHeader)
+	e.contacts(2, m.Contacts)
+	e.string(3, m.Value)
+	if m.Record != nil {
+		e.message(4, m.Record)
+	}
+	e.contacts(5, m.Providers)
+	e.bool(6, m.MoreProviders)
+}
+
+func (m *FindValueResponse) unmarshalProto(data []byte) error {
+	return decodeProto(data, func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			err = f.message(&m.RPCHeader)
+		case 2:
+			err = f.contact(&m.Contacts)
+		case 3:
+			m.Value, err = f.string()
+		case 4:
+			m.Record = &Record{}
+			err = f.message(m.Record)
+		case 5:
+			err = f.contact(&m.Providers)
+		case 6:
+			m.MoreProviders, err = f.bool()
+		}
+		return
+	})
+}
+
+func (m *StoreRequest) marshalProto(e *protoEncoder) {
+	e.message(1, &m.RPCHeader)
+	e.id(2, m.Key)
+	e.message(3, &m.Record)
+}
+
+func (m *StoreRequest) unmarshalProto(data []byte) error {
+	return decodeProto(data, func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			err = f.message(&m.RPCHeader)
+		case 2:
+			m.Key, err = f.id()
+		case 3:
+			err = f.message(&m.Record)
+		}
+		return
+	})
+}
+
+func (m *AddProviderRequest) marshalProto(e *protoEncoder) {
+	e.message(1, &m.RPCHeader)
+	e.id(2, m.Key)
+	e.int(3, int64(m.TTL))
+}
+
+func (m *AddProviderRequest) unmarshalProto(data []byte) error {
+	return decodeProto(data, func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			err = f.message(&m.RPCHeader)
+		case 2:
+			m.Key, err = f.id()
+		case 3:
+			var ttl int64
+			ttl, err = f.int()
+			m.TTL = time.Duration(ttl)
+		}
+		return
+	})
+}
+
+/*
+ * protoEnvelope
+ * Frames each request and response, length-prefixed by a varint
+ */
+
+type protoEnvelope struct {
+	Version uint64
+	Method  string
+	Seq     uint64
+	Error   string
+	Body    []byte
+}
+
+func (m *protoEnvelope) marshalProto(e *protoEncoder) {
+	e.uint(1, m.Version)
+	e.string(2, m.Method)
+	e.uint(3, m.Seq)
+	e.string(4, m.Error)
+	e.bytes(5, m.Body)
+}
+
+func (m *protoEnvelope) unmarshalProto(data []byte) error {
+	return decodeProto(data, func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			m.Version, err = f.uint()
+		case 2:
+			m.Method, err = f.string()
+		case 3:
+			m.Seq, err = f.uint()
+		case 4:
+			m.Error, err = f.string()
+		case 5:
+			m.Body, err = f.data()
+		}
+		return
+	})
+}
+
+func writeEnvelope(w io.Writer, envelope *protoEnvelope) error {
+	data := marshalProto(envelope)
+	frame := binary.AppendUvarint(nil, uint64(len(data)))
+	_, err := w.Write(append(frame, data...))
+	return err
+}
+
+func readEnvelope(r *bufio.Reader) (*protoEnvelope, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > MaxProtoMessage {
+		return nil, fmt.Errorf("Protobuf message of %d bytes too large", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	envelope := &protoEnvelope{}
+	if err := envelope.unmarshalProto(data); err != nil {
+		return nil, err
+	}
+	if envelope.Version != ProtoVersion {
+		return nil, fmt.Errorf("Unsupported protobuf schema version %d", envelope.Version)
+	}
+
+	return envelope, nil
+}
+
+func protoBody(body interface{}) ([]byte, error) {
+	m, ok := body.(protoMessage)
+	if !ok {
+		return nil, fmt.Errorf("No protobuf encoding for %T", body)
+	}
+
+	return marshalProto(m), nil
+}
+
+func unmarshalBody(data []byte, body interface{}) error {
+	if body == nil {
+		return nil
+	}
+
+	m, ok := body.(protoMessage)
+	if !ok {
+		return fmt.Errorf("No protobuf encoding for %T", body)
+	}
+
+	return m.unmarshalProto(data)
+}
+
+/*
+ * protoCodec
+ */
+
+type protoCodec struct{}
+
+func (protoCodec) Name() string {
+	return "proto"
+}
+
+func (protoCodec) NewClient(conn io.ReadWriteCloser) *rpc.Client {
+	return rpc.NewClientWithCodec(&protoClientCodec{conn: conn, r: bufio.NewReader(conn)})
+}
+
+func (protoCodec) ServeConn(server *rpc.Server, conn io.ReadWriteCloser) {
+	server.ServeCodec(&protoServerCodec{conn: conn, r: bufio.NewReader(conn)})
+}
+
+type protoClientCodec struct {
+	conn io.ReadWriteCloser
+	r    *bufio.Reader
+	body []byte
+}
+
+func (c *protoClientCodec) WriteRequest(req *rpc.Request, body interface{}) error {
+	data, err := protoBody(body)
+	if err != nil {
+		return err
+	}
+
+	return writeEnvelope(c.conn, &protoEnvelope{
+		Version: ProtoVersion,
+		Method:  req.ServiceMethod,
+		Seq:     req.Seq,
+		Body:    data,
+	})
+}
+
+func (c *protoClientCodec) ReadResponseHeader(res *rpc.Response) error {
+	envelope, err := readEnvelope(c.r)
+	if err != nil {
+		return err
+	}
+
+	res.ServiceMethod = envelope.Method
+	res.Seq = envelope.Seq
+	res.Error = envelope.Error
+	c.body = envelope.Body
+
+	return nil
+}
+
+func (c *protoClientCodec) ReadResponseBody(body interface{}) error {
+	return unmarshalBody(c.body, body)
+}
+
+func (c *protoClientCodec) Close() error {
+	return c.conn.Close()
+}
+
+type protoServerCodec struct {
+	conn io.ReadWriteCloser
+	r    *bufio.Reader
+	body []byte
+}
+
+func (c *protoServerCodec) ReadRequestHeader(req *rpc.Request) error {
+	envelope, err := readEnvelope(c.r)
+	if err != nil {
+		return err
+	}
+
+	req.ServiceMethod = envelope.Method
+	req.Seq = envelope.Seq
+	c.body = envelope.Body
+
+	return nil
+}
+
+func (c *protoServerCodec) ReadRequestBody(body interface{}) error {
+	return unmarshalBody(c.body, body)
+}
+
+func (c *protoServerCodec) WriteResponse(res *rpc.Response, body interface{}) error {
+	envelope := &protoEnvelope{
+		Version: ProtoVersion,
+		Method:  res.ServiceMethod,
+		Seq:     res.Seq,
+		Error:   res.Error,
+	}
+
+	if res.Error == "" {
+		data, err := protoBody(body)
+		if err != nil {
+			return err
+		}
+		envelope.Body = data
+	}
+
+	return writeEnvelope(c.conn, envelope)
+}
+
+func (c *protoServerCodec) Close() error {
+	return c.conn.Close()
+}
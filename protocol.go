@@ -0,0 +1,80 @@
+package kademlia
+
+import "fmt"
+
+const (
+	// Version of the RPC messages spoken by this node
+	ProtocolVersion = 1
+	// Oldest peer version whose messages are still understood
+	MinProtocolVersion = 1
+)
+
+// Optional services a node offers, advertised in every RPCHeader
+type Capabilities uint64
+
+const (
+	// Stores records and returns them from FIND_VALUE
+	CapRecords Capabilities = 1 << iota
+	// Keeps provider announcements
+	CapProviders
+
+	DefaultCapabilities = CapRecords | CapProviders
+)
+
+func (c Capabilities) Has(required Capabilities) bool {
+	return c&required == required
+}
+
+// Peers predating versioned headers send zeros, they speak version 1 and
+// offer every capability it had
+func peerProtocol(h RPCHeader) (version, minVersion uint32, capabilities Capabilities) {
+	if h.Version == 0 {
+		return 1, 1, DefaultCapabilities
+	}
+
+	return h.Version, h.MinVersion, h.Capabilities
+}
+
+// Peers are compatible when each understands the other's version
+func checkProtocol(h RPCHeader) error {
+	version, minVersion, _ := peerProtocol(h)
+	if version < MinProtocolVersion {
+		return fmt.Errorf("Peer speaks protocol version %d, oldest supported is %d",
+			version, MinProtocolVersion)
+	}
+	if minVersion > ProtocolVersion {
+		return fmt.Errorf("Peer requires protocol version %d, we speak %d",
+			minVersion, ProtocolVersion)
+	}
+
+	return nil
+}
+
+func (k *Kademlia) requireCapability(required Capabilities) error {
+	if !k.Capabilities.Has(required) {
+		return fmt.Errorf("Node does not offer capability %#x", uint64(required))
+	}
+	return nil
+}
+
+// Remembers what a contact in the table speaks and offers
+func (rt *RoutingTable) recordProtocol(h RPCHeader) {
+	version, _, capabilities := peerProtocol(h)
+
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	if metrics, ok := rt.metrics[h.Sender.ID]; ok {
+		metrics.Version = version
+		metrics.Capabilities = capabilities
+	}
+}
+
+// Whether a contact in the table is known to offer required
+func (rt *RoutingTable) Capable(id NodeID, required Capabilities) bool {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	metrics, ok := rt.metrics[id]
+	return ok && metrics.Capabilities.Has(required)
+}
@@ -0,0 +1,144 @@
+package kademlia
+
+import "testing"
+
+var protocolTests = []struct {
+	version    uint32
+	minVersion uint32
+	compatible bool
+}{
+	// Peers predating versioned headers
+	{0, 0, true},
+	{ProtocolVersion, MinProtocolVersion, true},
+	{ProtocolVersion + 1, ProtocolVersion, true},
+	{ProtocolVersion + 1, ProtocolVersion + 1, false},
+}
+
+func TestCheckProtocol(t *testing.T) {
+	for _, tt := range protocolTests {
+		err := checkProtocol(RPCHeader{Version: tt.version, MinVersion: tt.minVersion})
+		if (err == nil) != tt.compatible {
+			t.Errorf("Version %d, min %d: expected compatible %v, got %v",
+				tt.version, tt.minVersion, tt.compatible, err)
+		}
+	}
+}
+
+func TestHandleRPCRejectsIncompatiblePeer(t *testing.T) {
+	kad := newTestKademlia()
+	sender := NewContact(NewRandomNodeID(), "127.0.0.1:6001")
+
+	request := RPCHeader{
+		Sender:     sender,
+		NetworkID:  "test",
+		Version:    ProtocolVersion + 1,
+		MinVersion: ProtocolVersion + 1,
+	}
+	if kad.HandleRPC(request, &RPCHeader{}) == nil {
+		t.Error("Peer requiring a newer protocol should be rejected")
+	}
+	if kad.routes.Contains(sender.ID) {
+		t.Error("Incompatible peer should not be added to the routing table")
+	}
+
+	request.MinVersion = ProtocolVersion
+	request.Capabilities = CapProviders
+	if err := kad.HandleRPC(request, &RPCHeader{}); err != nil {
+		t.Fatal("Newer peer still speaking our version should be accepted:", err)
+	}
+	if !kad.routes.Capable(sender.ID, CapProviders) || kad.routes.Capable(sender.ID, CapRecords) {
+		t.Error("Advertised capabilities should be recorded")
+	}
+
+	// Legacy peers offer everything version 1 did
+	legacy := NewContact(NewRandomNodeID(), "127.0.0.1:6002")
+	kad.HandleRPC(RPCHeader{Sender: legacy, NetworkID: "test"}, &RPCHeader{})
+	if !kad.routes.Capable(legacy.ID, DefaultCapabilities) {
+		t.Error("Legacy peers should be assumed to offer default capabilities")
+	}
+}
+
+func TestLookupsSkipIncapablePeers(t *testing.T) {
+	client := newTestNode(t)
+	storer := newTestNode(t)
+	router := newTestNode(t)
+	router.Capabilities = CapProviders
+
+	client.routes.Update(storer.routes.Self())
+	client.routes.Update(router.routes.Self())
+
+	record := NewImmutableRecord([]byte("value"))
+	key := ImmutableKey(record.Value)
+	if err := client.Store(router.routes.Self(), key, record); err == nil {
+		t.Error("Node without records capability should refuse to store")
+	}
+
+	stored, err := client.StoreRecord(key, record)
+	if err != nil || stored != 1 {
+		t.Errorf("Expected record stored on 1 node, got %d, %v", stored, err)
+	}
+	if !client.routes.Capable(storer.routes.Self().ID, DefaultCapabilities) {
+		t.Error("Capabilities of queried peers should be recorded")
+	}
+
+	if _, err := client.Provide(key, ProviderTTL); err != nil {
+		t.Fatal(err)
+	}
+	providers, err := client.FindProviders(key)
+	if err != nil || providers.Len() != 1 || providers[0] != client.routes.Self() {
+		t.Errorf("Expected ourselves as the only provider, got %v, %v", providers, err)
+	}
+}
+
+// Responders are judged by what they advertised, also those our routing table
+// has no room for
+func TestCapableLookupBeyondRoutingTable(t *testing.T) {
+	client := newTestNode(t)
+	client.SetRoutingConfig(RoutingConfig{MaxSubnetPerTable: 2, PreferLongLived: true})
+
+	nodes := []*Kademlia{}
+	for i := 0; i < 6; i++ {
+		nodes = append(nodes, newTestNode(t))
+	}
+	router := nodes[0]
+	router.Capabilities = CapProviders
+	for _, node := range nodes {
+		for _, other := range nodes {
+			node.routes.Update(other.routes.Self())
+		}
+	}
+	client.routes.Update(router.routes.Self())
+
+	found := client.findCapable(NewRandomNodeID(), CapRecords)
+	if found.Len() != len(nodes)-1 {
+		t.Errorf("Expected %d capable nodes, got %d", len(nodes)-1, found.Len())
+	}
+	for _, contact := range found {
+		if contact.ID == router.routes.Self().ID {
+			t.Error("Nodes without the capability should be skipped")
+		}
+	}
+	if client.routes.Size() > 2 {
+		t.Fatalf("Routing table should hold at most 2 contacts, holds %d",
+			client.routes.Size())
+	}
+}
+
+func TestNodeWithoutCapabilities(t *testing.T) {
+	client := newTestNode(t)
+	router := newTestNode(t)
+	router.Capabilities = 0
+
+	if err := client.Ping(router.routes.Self()); err != nil {
+		t.Fatal(err)
+	}
+	if client.routes.Capable(router.routes.Self().ID, CapRecords) ||
+		client.routes.Capable(router.routes.Self().ID, CapProviders) {
+		t.Error("Node advertising no capabilities should be recorded as offering none")
+	}
+
+	record := NewImmutableRecord([]byte("value"))
+	if client.Store(router.routes.Self(), ImmutableKey(record.Value), record) == nil {
+		t.Error("Node without capabilities should refuse to store")
+	}
+}
@@ -0,0 +1,328 @@
+package kademlia
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	db "github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"time"
+)
+
+const (
+	ProviderTTL      = 24 * time.Hour
+	MaxProviderTTL   = 48 * time.Hour
+	ProviderPageSize = 20
+	// Pages fetched from a single node before giving up on the rest
+	MaxProviderPages = 50
+)
+
+type ProviderRecord struct {
+	Provider Contact
+	Expires  time.Time
+	// Original peer ID of providers announced over libp2p, whose Node ID is
+	// only its hash
+	PeerID []byte
+}
+
+type AddProviderRequest struct {
+	RPCHeader
+	Key NodeID
+	TTL time.Duration
+}
+
+func (k *Kademlia) NewAddProviderRequest(key NodeID, ttl time.Duration) AddProviderRequest {
+	return AddProviderRequest{
+		RPCHeader: k.newRPCHeader(),
+		Key:       key,
+		TTL:       ttl,
+	}
+}
+
+type AddProviderResponse struct {
+	RPCHeader
+}
+
+// Announces to contact that we provide key for ttl
+func (k *Kademlia) AddProvider(contact Contact, key NodeID, ttl time.Duration) error {
+	req := k.NewAddProviderRequest(key, ttl)
+	res := AddProviderResponse{}
+
+	return k.call(contact, "KademliaCore.AddProviderRPC", &req, &res)
+}
+
+// Peers may only announce themselves as providers
+func (kc *KademliaCore) AddProviderRPC(req AddProviderRequest, res *AddProviderResponse) error {
+	err := kc.handleRPC(req.RPCHeader, &res.RPCHeader)
+	if err != nil {
+		return err
+	}
+
+	err = kc.kad.requireCapability(CapProviders)
+	if err != nil {
+		return err
+	}
+
+	ttl := req.TTL
+	if ttl <= 0 || ttl > MaxProviderTTL {
+		ttl = ProviderTTL
+	}
+
+	return kc.kad.putProvider(req.Key, ProviderRecord{
+		Provider: req.Sender,
+		Expires:  time.Now().Add(ttl),
+	}, storeOwner{ID: req.Sender.ID, IP: kc.remoteIP})
+}
+
+// Fetches up to MaxProviderPages pages of live providers contact knows for
+// key.  Pages must be ordered by ID, so a node cannot keep us paging forever.
+func (k *Kademlia) GetProviders(contact Contact, key NodeID) (Contacts, error) {
+	providers := Contacts{}
+	after := NodeID{}
+
+	for page := 0; page < MaxProviderPages; page++ {
+		req := k.NewFindValueRequest(key)
+		req.ProvidersAfter = after
+		res := FindValueResponse{}
+
+		err := k.call(contact, "KademliaCore.FindValueRPC", &req, &res)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, provider := range res.Providers {
+			if !after.Less(provider.ID) {
+				return nil, fmt.Errorf("Providers from %s not ordered after %s",
+					contact.Address, after)
+			}
+			after = provider.ID
+		}
+
+		providers = append(providers, res.Providers...)
+		if !res.MoreProviders || res.Providers.Len() == 0 {
+			break
+		}
+	}
+
+	return providers, nil
+}
+
+// Announces ourselves as a provider of key to the BucketSize closest nodes
+func (k *Kademlia) Provide(key NodeID, ttl time.Duration) (int, error) {
+	announced := 0
+	var lastErr error
+	for _, contact := range k.findCapable(key, CapProviders) {
+		err := k.AddProvider(contact, key, ttl)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		announced++
+	}
+
+	if announced == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("No nodes available to announce provider")
+		}
+		return 0, lastErr
+	}
+
+	return announced, nil
+}
+
+// Collects the live providers of key from the BucketSize closest nodes
+func (k *Kademlia) FindProviders(key NodeID) (Contacts, error) {
+	providers := Contacts{}
+	seen := make(map[NodeID]struct{})
+	for _, contact := range k.findCapable(key, CapProviders) {
+		found, err := k.GetProviders(contact, key)
+		if err != nil {
+			continue
+		}
+
+		for _, provider := range found {
+			if _, ok := seen[provider.ID]; !ok {
+				providers = append(providers, provider)
+				seen[provider.ID] = struct{}{}
+			}
+		}
+	}
+
+	return providers, nil
+}
+
+/*
+ * Providers database
+ */
+
+func providersPrefix(key NodeID) []byte {
+	return append([]byte("p"), key[:]...)
+}
+
+func providerKey(key, provider NodeID) []byte {
+	return append(providersPrefix(key), provider[:]...)
+}
+
+// Providers are stored along with who announced them, for quota accounting
+type storedProvider struct {
+	Record ProviderRecord
+	Owner  storeOwner
+}
+
+func decodeStoredProvider(data []byte) (*storedProvider, error) {
+	stored := &storedProvider{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+// Announcements count against the same quotas as records
+func (k *Kademlia) putProvider(key NodeID, record ProviderRecord, owner storeOwner) error {
+	k.storeMutex.Lock()
+	defer k.storeMutex.Unlock()
+
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(storedProvider{record, owner})
+	if err != nil {
+		return err
+	}
+
+	usage, err := k.storeUsage()
+	if err != nil {
+		return err
+	}
+
+	batch := new(db.Batch)
+	change := usage.change()
+
+	dbKey := providerKey(key, record.Provider.ID)
+	data, err := k.valuesDB.Get(dbKey, nil)
+	if err == nil {
+		existing, err := decodeStoredProvider(data)
+		if err != nil {
+			return err
+		}
+		change.remove(newStoredEntry(dbKey, existing.Owner, int64(len(data)),
+			existing.Record.Expires))
+	} else if err != db.ErrNotFound {
+		return err
+	}
+	change.add(newStoredEntry(dbKey, owner, int64(buffer.Len()), record.Expires))
+
+	limits := k.StoreLimits
+	err = change.checkQuotas(owner, limits)
+	if err != nil {
+		return err
+	}
+
+	err = k.evictFor(key, change, limits, batch)
+	if err != nil {
+		return err
+	}
+
+	batch.Put(dbKey, buffer.Bytes())
+	err = k.valuesDB.Write(batch, nil)
+	if err != nil {
+		return err
+	}
+
+	usage.apply(change)
+
+	return nil
+}
+
+// Returns up to limit live providers ordered by ID after the given one, and
+// whether more remain.  Expired providers are dropped along the way.
+func (k *Kademlia) getProviders(key, after NodeID, limit int) (Contacts, bool, error) {
+	records, more, err := k.getProviderRecords(key, after, limit)
+	if err != nil {
+		return nil, false, err
+	}
+
+	providers := make(Contacts, 0, len(records))
+	for _, record := range records {
+		providers = append(providers, record.Provider)
+	}
+
+	return providers, more, nil
+}
+
+func (k *Kademlia) getProviderRecords(key, after NodeID, limit int) ([]ProviderRecord,
+	bool, error) {
+	k.storeMutex.Lock()
+	defer k.storeMutex.Unlock()
+
+	iter := k.valuesDB.NewIterator(util.BytesPrefix(providersPrefix(key)), nil)
+	defer iter.Release()
+
+	records := []ProviderRecord{}
+	expired := []storedEntry{}
+	now := time.Now()
+
+	ok := iter.First()
+	if after != (NodeID{}) {
+		start := providerKey(key, after)
+		ok = iter.Seek(start)
+		if ok && bytes.Equal(iter.Key(), start) {
+			ok = iter.Next()
+		}
+	}
+
+	more := false
+	for ; ok; ok = iter.Next() {
+		stored, err := decodeStoredProvider(iter.Value())
+		if err != nil {
+			return nil, false, err
+		}
+
+		if now.After(stored.Record.Expires) {
+			expired = append(expired, newStoredEntry(iter.Key(), stored.Owner,
+				int64(len(iter.Value())), stored.Record.Expires))
+			continue
+		}
+
+		if len(records) == limit {
+			more = true
+			break
+		}
+		records = append(records, stored.Record)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, false, err
+	}
+
+	return records, more, k.dropExpired(expired)
+}
+
+// Deletes expired providers, returning their space to their owners' quotas.
+// Callers must hold storeMutex.
+func (k *Kademlia) dropExpired(expired []storedEntry) error {
+	if len(expired) == 0 {
+		return nil
+	}
+
+	usage, err := k.storeUsage()
+	if err != nil {
+		return err
+	}
+
+	batch := new(db.Batch)
+	change := usage.change()
+	for _, entry := range expired {
+		batch.Delete(entry.dbKey)
+		change.remove(entry)
+	}
+
+	err = k.valuesDB.Write(batch, nil)
+	if err != nil {
+		return err
+	}
+
+	usage.apply(change)
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package kademlia
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+func TestAddProvider(t *testing.T) {
+	server := newTestNode(t)
+	providers := []*Kademlia{newTestNode(t), newTestNode(t), newTestNode(t)}
+	key := NewRandomNodeID()
+
+	for _, provider := range providers {
+		if err := provider.AddProvider(server.routes.Self(), key, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	found, err := providers[0].GetProviders(server.routes.Self(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Len() != len(providers) {
+		t.Errorf("Expected %d providers, got %d", len(providers), found.Len())
+	}
+}
+
+func TestProvidersExpire(t *testing.T) {
+	server := newTestNode(t)
+	key := NewRandomNodeID()
+
+	live := ProviderRecord{Provider: NewContact(NewRandomNodeID(), ""), Expires: time.Now().Add(time.Hour)}
+	expired := ProviderRecord{Provider: NewContact(NewRandomNodeID(), ""), Expires: time.Now().Add(-time.Second)}
+	server.putProvider(key, live, localOwner)
+	server.putProvider(key, expired, localOwner)
+
+	found, more, err := server.getProviders(key, NodeID{}, ProviderPageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if more || found.Len() != 1 || found[0] != live.Provider {
+		t.Error("Only the live provider should be returned")
+	}
+}
+
+func TestProvidersPaginate(t *testing.T) {
+	server := newTestNode(t)
+	client := newTestNode(t)
+	key := NewRandomNodeID()
+
+	total := 2*ProviderPageSize + 5
+	for i := 0; i < total; i++ {
+		provider := NewContact(NewRandomNodeID(), "")
+		server.putProvider(key, ProviderRecord{Provider: provider, Expires: time.Now().Add(time.Hour)},
+			localOwner)
+	}
+
+	page, more, err := server.getProviders(key, NodeID{}, ProviderPageSize)
+	if err != nil || !more || page.Len() != ProviderPageSize {
+		t.Error("First page should be full and report more providers")
+	}
+
+	found, err := client.GetProviders(server.routes.Self(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[NodeID]struct{})
+	for _, provider := range found {
+		seen[provider.ID] = struct{}{}
+	}
+	if len(seen) != total {
+		t.Errorf("Expected %d distinct providers across pages, got %d", total, len(seen))
+	}
+}
+
+// Serves the first page of providers whatever cursor it is asked for
+type stuckProviders struct {
+	kc *KademliaCore
+}
+
+func (s *stuckProviders) FindValueRPC(req FindValueRequest, res *FindValueResponse) error {
+	req.ProvidersAfter = NodeID{}
+	err := s.kc.FindValueRPC(req, res)
+	res.MoreProviders = true
+	return err
+}
+
+func TestGetProvidersStuckCursor(t *testing.T) {
+	server := newTestNode(t)
+	client := newTestNode(t)
+	key := NewRandomNodeID()
+	server.putProvider(key, ProviderRecord{
+		Provider: NewContact(NewRandomNodeID(), ""),
+		Expires:  time.Now().Add(time.Hour),
+	}, localOwner)
+
+	// Take over the server's address with one that never advances
+	for _, l := range server.listeners {
+		l.Close()
+	}
+	l, err := net.Listen("tcp", server.routes.Self().Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			codec, accepted, err := server.acceptCodec(conn)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			rpcServer := rpc.NewServer()
+			rpcServer.RegisterName("KademliaCore", &stuckProviders{&KademliaCore{kad: server}})
+			go codec.ServeConn(rpcServer, accepted)
+		}
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.GetProviders(server.routes.Self(), key)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Providers repeating the cursor should be rejected")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Paging providers did not terminate")
+	}
+}
@@ -0,0 +1,318 @@
+package kademlia
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	db "github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"sort"
+	"time"
+)
+
+// Limits on what peers may store with us, zero disables a limit
+type StoreLimits struct {
+	MaxValueSize   int
+	MaxTotalBytes  int64
+	MaxSenderBytes int64
+	MaxIPBytes     int64
+}
+
+var (
+	ErrValueTooLarge = errors.New("Value too large")
+	ErrSenderQuota   = errors.New("Sender storage quota exceeded")
+	ErrIPQuota       = errors.New("IP storage quota exceeded")
+	ErrStoreFull     = errors.New("Store is full")
+)
+
+/*
+ * storeUsage
+ * Bytes stored in total, per sender ID and per IP, along with an index of
+ * stored entries for choosing what to evict without reading the database
+ */
+
+type storeUsage struct {
+	total    int64
+	bySender map[NodeID]int64
+	byIP     map[string]int64
+	self     NodeID
+	// Entries farthest from self first
+	byDistance []storedEntry
+	// Providers soonest to expire first
+	byExpiry []storedEntry
+}
+
+func newStoreUsage() *storeUsage {
+	return &storeUsage{
+		bySender: make(map[NodeID]int64),
+		byIP:     make(map[string]int64),
+	}
+}
+
+// Loads usage from the values database on first use, callers must hold
+// storeMutex
+func (k *Kademlia) storeUsage() (*storeUsage, error) {
+	if k.usage != nil {
+		return k.usage, nil
+	}
+
+	usage := newStoreUsage()
+	usage.self = k.routes.self.ID
+	err := k.forEachStored(func(entry storedEntry) {
+		usage.add(entry.owner, entry.size)
+		usage.index(entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	k.usage = usage
+	return usage, nil
+}
+
+// Our own records only count towards the total
+func (u *storeUsage) add(owner storeOwner, size int64) {
+	u.total += size
+	if owner.Local {
+		return
+	}
+	u.bySender[owner.ID] += size
+	u.byIP[owner.IP] += size
+}
+
+func (u *storeUsage) farther(a, b storedEntry) bool {
+	return b.key.Xor(u.self).Less(a.key.Xor(u.self))
+}
+
+func expiresSooner(a, b storedEntry) bool {
+	return a.expires < b.expires
+}
+
+func (u *storeUsage) index(entry storedEntry) {
+	u.byDistance = insertEntry(u.byDistance, entry, u.farther)
+	if entry.expires != 0 {
+		u.byExpiry = insertEntry(u.byExpiry, entry, expiresSooner)
+	}
+}
+
+func (u *storeUsage) unindex(entry storedEntry) {
+	u.byDistance = removeEntry(u.byDistance, entry, u.farther)
+	if entry.expires != 0 {
+		u.byExpiry = removeEntry(u.byExpiry, entry, expiresSooner)
+	}
+}
+
+// Inserts entry after any it does not sort before
+func insertEntry(entries []storedEntry, entry storedEntry,
+	before func(a, b storedEntry) bool) []storedEntry {
+	i := sort.Search(len(entries), func(i int) bool {
+		return before(entry, entries[i])
+	})
+
+	entries = append(entries, storedEntry{})
+	copy(entries[i+1:], entries[i:])
+	entries[i] = entry
+
+	return entries
+}
+
+func removeEntry(entries []storedEntry, entry storedEntry,
+	before func(a, b storedEntry) bool) []storedEntry {
+	i := sort.Search(len(entries), func(i int) bool {
+		return !before(entries[i], entry)
+	})
+
+	for ; i < len(entries) && !before(entry, entries[i]); i++ {
+		if bytes.Equal(entries[i].dbKey, entry.dbKey) {
+			return append(entries[:i], entries[i+1:]...)
+		}
+	}
+
+	return entries
+}
+
+func (u *storeUsage) change() *usageChange {
+	return &usageChange{
+		usage:   u,
+		delta:   newStoreUsage(),
+		removed: make(map[string]bool),
+	}
+}
+
+func (u *storeUsage) apply(change *usageChange) {
+	u.total += change.delta.total
+	for id, size := range change.delta.bySender {
+		u.bySender[id] += size
+		if u.bySender[id] <= 0 {
+			delete(u.bySender, id)
+		}
+	}
+	for ip, size := range change.delta.byIP {
+		u.byIP[ip] += size
+		if u.byIP[ip] <= 0 {
+			delete(u.byIP, ip)
+		}
+	}
+
+	for _, entry := range change.removedEntries {
+		u.unindex(entry)
+	}
+	for _, entry := range change.added {
+		u.index(entry)
+	}
+}
+
+/*
+ * usageChange
+ * Pending adjustments to storeUsage, applied once a write succeeds
+ */
+
+type usageChange struct {
+	usage          *storeUsage
+	delta          *storeUsage
+	added          []storedEntry
+	removedEntries []storedEntry
+	removed        map[string]bool
+}
+
+func (c *usageChange) add(entry storedEntry) {
+	c.delta.add(entry.owner, entry.size)
+	c.added = append(c.added, entry)
+}
+
+func (c *usageChange) remove(entry storedEntry) {
+	c.delta.add(entry.owner, -entry.size)
+	c.removedEntries = append(c.removedEntries, entry)
+	c.removed[string(entry.dbKey)] = true
+}
+
+func (c *usageChange) total() int64 {
+	return c.usage.total + c.delta.total
+}
+
+// Records we store ourselves are exempt from quotas, everything else is
+// charged to the sender and the IP it connected from
+func (c *usageChange) checkQuotas(owner storeOwner, limits StoreLimits) error {
+	if owner.Local {
+		return nil
+	}
+
+	sender := c.usage.bySender[owner.ID] + c.delta.bySender[owner.ID]
+	if limits.MaxSenderBytes > 0 && sender > limits.MaxSenderBytes {
+		return fmt.Errorf("%w: %s would store %d of %d bytes", ErrSenderQuota,
+			owner.ID, sender, limits.MaxSenderBytes)
+	}
+
+	ip := c.usage.byIP[owner.IP] + c.delta.byIP[owner.IP]
+	if limits.MaxIPBytes > 0 && ip > limits.MaxIPBytes {
+		return fmt.Errorf("%w: %s would store %d of %d bytes", ErrIPQuota,
+			owner.IP, ip, limits.MaxIPBytes)
+	}
+
+	return nil
+}
+
+// Makes room for key by evicting expired providers, then the records and
+// providers farthest from our own ID, as long as they are farther than key
+// itself
+func (k *Kademlia) evictFor(key NodeID, change *usageChange, limits StoreLimits,
+	batch *db.Batch) error {
+	if limits.MaxTotalBytes <= 0 || change.total() <= limits.MaxTotalBytes {
+		return nil
+	}
+
+	evict := func(entry storedEntry) {
+		if !change.removed[string(entry.dbKey)] {
+			batch.Delete(entry.dbKey)
+			change.remove(entry)
+		}
+	}
+
+	now := time.Now().UnixNano()
+	for _, entry := range change.usage.byExpiry {
+		if entry.expires >= now || change.total() <= limits.MaxTotalBytes {
+			break
+		}
+		evict(entry)
+	}
+
+	limit := key.Xor(change.usage.self)
+	for _, entry := range change.usage.byDistance {
+		if change.total() <= limits.MaxTotalBytes ||
+			!limit.Less(entry.key.Xor(change.usage.self)) {
+			break
+		}
+		evict(entry)
+	}
+
+	if change.total() > limits.MaxTotalBytes {
+		return fmt.Errorf("%w: %d bytes exceeds %d", ErrStoreFull, change.total(),
+			limits.MaxTotalBytes)
+	}
+
+	return nil
+}
+
+// Records under "v" and providers under "p", each charged to its owner.
+// Providers expire at expires in Unix nanoseconds, records never do.
+type storedEntry struct {
+	dbKey   []byte
+	key     NodeID
+	owner   storeOwner
+	size    int64
+	expires int64
+}
+
+func newStoredEntry(dbKey []byte, owner storeOwner, size int64,
+	expires time.Time) storedEntry {
+	entry := storedEntry{
+		dbKey: append([]byte{}, dbKey...),
+		owner: owner,
+		size:  size,
+	}
+	copy(entry.key[:], dbKey[1:])
+	if !expires.IsZero() {
+		entry.expires = expires.UnixNano()
+	}
+
+	return entry
+}
+
+func (k *Kademlia) forEachStored(f func(storedEntry)) error {
+	for _, prefix := range []string{"v", "p"} {
+		err := k.forEachStoredPrefix(prefix, f)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (k *Kademlia) forEachStoredPrefix(prefix string, f func(storedEntry)) error {
+	iter := k.valuesDB.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		var owner storeOwner
+		var expires time.Time
+		if prefix == "v" {
+			stored, err := decodeStoredRecord(iter.Value())
+			if err != nil {
+				return err
+			}
+			owner = stored.Owner
+		} else {
+			stored, err := decodeStoredProvider(iter.Value())
+			if err != nil {
+				return err
+			}
+			owner = stored.Owner
+			expires = stored.Record.Expires
+		}
+
+		f(newStoredEntry(iter.Key(), owner, int64(len(iter.Value())), expires))
+	}
+
+	return iter.Error()
+}
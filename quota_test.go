@@ -0,0 +1,217 @@
+package kademlia
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func storedSize(t *testing.T, record Record, owner storeOwner) int64 {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(storedRecord{record, owner}); err != nil {
+		t.Fatal(err)
+	}
+	return int64(buffer.Len())
+}
+
+func TestStoreRejectsLargeValue(t *testing.T) {
+	server := newTestNode(t)
+	client := newTestNode(t)
+	server.StoreLimits.MaxValueSize = 8
+
+	value := []byte("much too large")
+	err := client.Store(server.routes.Self(), ImmutableKey(value), NewImmutableRecord(value))
+	if err == nil || !strings.Contains(err.Error(), ErrValueTooLarge.Error()) {
+		t.Error("Values over the size limit should be rejected, got", err)
+	}
+}
+
+func TestStoreSenderAndIPQuotas(t *testing.T) {
+	server := newTestNode(t)
+	first := newTestNode(t)
+	second := newTestNode(t)
+
+	record := NewImmutableRecord([]byte("0"))
+	owner := storeOwner{ID: first.routes.Self().ID, IP: "127.0.0.1"}
+	// Encoded sizes vary slightly with the owner's ID, leave some slack
+	server.StoreLimits.MaxSenderBytes = storedSize(t, record, owner) + 64
+	server.StoreLimits.MaxIPBytes = server.StoreLimits.MaxSenderBytes + 32
+
+	store := func(client *Kademlia, value string) error {
+		return client.Store(server.routes.Self(), ImmutableKey([]byte(value)),
+			NewImmutableRecord([]byte(value)))
+	}
+
+	if err := store(first, "0"); err != nil {
+		t.Fatal(err)
+	}
+	err := store(first, "1")
+	if err == nil || !strings.Contains(err.Error(), ErrSenderQuota.Error()) {
+		t.Error("Sender over its quota should be rejected, got", err)
+	}
+
+	// Both clients connect from the same address
+	err = store(second, "2")
+	if err == nil || !strings.Contains(err.Error(), ErrIPQuota.Error()) {
+		t.Error("IP over its quota should be rejected, got", err)
+	}
+
+	// Replacing a record does not count twice against the quota
+	if err := store(first, "0"); err != nil {
+		t.Error("Re-storing the same record should fit the quota:", err)
+	}
+}
+
+func TestStoreEvictsFarthestRecords(t *testing.T) {
+	server := newTestNode(t)
+	self := server.routes.Self().ID
+	owner := storeOwner{ID: NewRandomNodeID(), IP: "127.0.0.1"}
+
+	far := self
+	far[0] ^= 0x80
+	farther := self
+	farther[0] ^= 0xc0
+	near := self
+	near[IDLength-1] ^= 0x01
+
+	record := NewValueRecord([]byte("value"))
+	server.StoreLimits.MaxTotalBytes = 2 * storedSize(t, record, owner)
+
+	for _, key := range []NodeID{farther, far, near} {
+		if err := server.putRecord(key, record, owner); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if stored, _ := server.getRecord(farther); stored != nil {
+		t.Error("Farthest record should be evicted when the store is full")
+	}
+	for _, key := range []NodeID{far, near} {
+		if stored, _ := server.getRecord(key); stored == nil {
+			t.Error("Closer records should be kept")
+		}
+	}
+
+	err := server.putRecord(farther, record, owner)
+	if !errors.Is(err, ErrStoreFull) {
+		t.Error("Record farther than everything stored should be refused, got", err)
+	}
+}
+
+func TestProviderQuotas(t *testing.T) {
+	server := newTestNode(t)
+	client := newTestNode(t)
+
+	announce := func() error {
+		return client.AddProvider(server.routes.Self(), NewRandomNodeID(), time.Hour)
+	}
+
+	if err := announce(); err != nil {
+		t.Fatal(err)
+	}
+	usage := func() *storeUsage {
+		server.storeMutex.Lock()
+		defer server.storeMutex.Unlock()
+
+		usage, err := server.storeUsage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return usage
+	}
+	used := usage().bySender[client.routes.Self().ID]
+	if used == 0 {
+		t.Fatal("Providers should count against the sender's quota")
+	}
+
+	// Encoded sizes vary slightly with the key, leave some slack
+	server.StoreLimits.MaxSenderBytes = used + 32
+	err := announce()
+	if err == nil || !strings.Contains(err.Error(), ErrSenderQuota.Error()) {
+		t.Error("Sender over its quota should be rejected, got", err)
+	}
+
+	server.StoreLimits.MaxSenderBytes = 0
+	server.StoreLimits.MaxIPBytes = used + 32
+	err = announce()
+	if err == nil || !strings.Contains(err.Error(), ErrIPQuota.Error()) {
+		t.Error("IP over its quota should be rejected, got", err)
+	}
+
+	// Records and providers share the store, a record either evicts the
+	// provider or is refused
+	server.StoreLimits.MaxIPBytes = 0
+	server.StoreLimits.MaxTotalBytes = used + 32
+	value := []byte("value")
+	client.Store(server.routes.Self(), ImmutableKey(value), NewImmutableRecord(value))
+	if total := usage().total; total > server.StoreLimits.MaxTotalBytes {
+		t.Errorf("Store holds %d bytes over its %d limit", total,
+			server.StoreLimits.MaxTotalBytes)
+	}
+}
+
+// Remote stores are charged even when the sender claims no ID
+func TestZeroSenderBoundByQuota(t *testing.T) {
+	server := newTestNode(t)
+	core := &KademliaCore{kad: server, remoteIP: "127.0.0.1"}
+
+	record := NewImmutableRecord([]byte("0"))
+	server.StoreLimits.MaxSenderBytes = storedSize(t, record, storeOwner{}) + 64
+
+	store := func(value string) error {
+		req := StoreRequest{
+			RPCHeader: RPCHeader{Sender: NewContact(NodeID{}, ""), NetworkID: server.NetworkID},
+			Key:       ImmutableKey([]byte(value)),
+			Record:    NewImmutableRecord([]byte(value)),
+		}
+		return core.StoreRPC(req, &StoreResponse{})
+	}
+
+	if err := store("0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store("1"); !errors.Is(err, ErrSenderQuota) {
+		t.Error("Sender without an ID over its quota should be rejected, got", err)
+	}
+
+	// Our own records are not
+	if err := server.putRecord(ImmutableKey([]byte("1")), NewImmutableRecord([]byte("1")),
+		localOwner); err != nil {
+		t.Error("Local stores should be exempt from quotas:", err)
+	}
+}
+
+func TestStoreEvictsExpiredProvidersFirst(t *testing.T) {
+	server := newTestNode(t)
+	self := server.routes.Self().ID
+	owner := storeOwner{ID: NewRandomNodeID(), IP: "127.0.0.1"}
+
+	far := self
+	far[0] ^= 0x80
+	near := self
+	near[IDLength-1] ^= 0x01
+
+	// The expired provider is nearer than anything else
+	expired := ProviderRecord{Provider: NewContact(NewRandomNodeID(), ""),
+		Expires: time.Now().Add(-time.Second)}
+	if err := server.putProvider(near, expired, owner); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the record fits, and it is farther than the provider
+	record := NewValueRecord([]byte("value"))
+	server.StoreLimits.MaxTotalBytes = storedSize(t, record, owner)
+	if err := server.putRecord(far, record, owner); err != nil {
+		t.Fatal("Expired provider should make room:", err)
+	}
+
+	if found, _, _ := server.getProviderRecords(near, NodeID{}, ProviderPageSize); len(found) != 0 {
+		t.Error("Expired provider should be evicted")
+	}
+	if _, err := server.valuesDB.Get(providerKey(near, expired.Provider.ID), nil); err == nil {
+		t.Error("Expired provider should be deleted from the database")
+	}
+}
@@ -0,0 +1,130 @@
+package kademlia
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	MaxSaltSize = 64
+)
+
+type RecordKind uint8
+
+const (
+	// Plain value stored under an arbitrary key
+	ValueRecord RecordKind = iota
+	// BEP-44 style record owned by an ed25519 key
+	MutableRecord
+	// Content-addressed record keyed by the hash of its value
+	ImmutableRecord
+)
+
+type Record struct {
+	Kind      RecordKind
+	Value     []byte
+	PublicKey []byte
+	Salt      []byte
+	Seq       int64
+	Signature []byte
+}
+
+func NewValueRecord(value []byte) Record {
+	return Record{
+		Kind:  ValueRecord,
+		Value: value,
+	}
+}
+
+func NewImmutableRecord(value []byte) Record {
+	return Record{
+		Kind:  ImmutableRecord,
+		Value: value,
+	}
+}
+
+// Signs value for publishing under MutableKey(private.Public(), salt)
+func NewMutableRecord(private ed25519.PrivateKey, salt []byte, seq int64,
+	value []byte) Record {
+	record := Record{
+		Kind:      MutableRecord,
+		Value:     value,
+		PublicKey: private.Public().(ed25519.PublicKey),
+		Salt:      salt,
+		Seq:       seq,
+	}
+	record.Signature = ed25519.Sign(private, record.signable())
+
+	return record
+}
+
+// Mutable records are keyed by the hash of their public key and salt
+func MutableKey(key ed25519.PublicKey, salt []byte) NodeID {
+	return NodeID(sha1.Sum(append(append([]byte{}, key...), salt...)))
+}
+
+func ImmutableKey(value []byte) NodeID {
+	return NodeID(sha1.Sum(value))
+}
+
+func (r Record) Verify(key NodeID) error {
+	switch r.Kind {
+	case ValueRecord:
+		return nil
+	case MutableRecord:
+		if len(r.PublicKey) != ed25519.PublicKeySize {
+			return errors.New("Mutable record has a malformed public key")
+		}
+		if len(r.Salt) > MaxSaltSize {
+			return fmt.Errorf("Mutable record salt exceeds %d bytes", MaxSaltSize)
+		}
+		if MutableKey(r.PublicKey, r.Salt) != key {
+			return fmt.Errorf("Mutable record does not belong under key %s", key)
+		}
+		if !ed25519.Verify(r.PublicKey, r.signable(), r.Signature) {
+			return errors.New("Mutable record has an invalid signature")
+		}
+		return nil
+	case ImmutableRecord:
+		if ImmutableKey(r.Value) != key {
+			return fmt.Errorf("Immutable record does not hash to key %s", key)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Unknown record kind %d", r.Kind)
+}
+
+// Whether r may replace existing under the same key
+func (r Record) Supersedes(existing Record) error {
+	switch {
+	case r.Kind == ValueRecord && existing.Kind != ValueRecord:
+		return errors.New("Key is owned by a signed record")
+	case r.Kind == MutableRecord && existing.Kind == MutableRecord &&
+		r.Seq <= existing.Seq:
+		return fmt.Errorf("Sequence number %d is not higher than stored %d",
+			r.Seq, existing.Seq)
+	}
+
+	return nil
+}
+
+// Bencoded salt, seq and value as signed by BEP-44
+func (r Record) signable() []byte {
+	var buffer bytes.Buffer
+
+	if len(r.Salt) > 0 {
+		buffer.WriteString("4:salt")
+		buffer.WriteString(strconv.Itoa(len(r.Salt)) + ":")
+		buffer.Write(r.Salt)
+	}
+	buffer.WriteString("3:seqi" + strconv.FormatInt(r.Seq, 10) + "e")
+	buffer.WriteString("1:v" + strconv.Itoa(len(r.Value)) + ":")
+	buffer.Write(r.Value)
+
+	return buffer.Bytes()
+}
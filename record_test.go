@@ -0,0 +1,73 @@
+package kademlia
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+)
+
+func newTestKey(t *testing.T) ed25519.PrivateKey {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private
+}
+
+func TestMutableRecordVerify(t *testing.T) {
+	private := newTestKey(t)
+	salt := []byte("profile")
+	record := NewMutableRecord(private, salt, 1, []byte("hello"))
+	key := MutableKey(record.PublicKey, salt)
+
+	if err := record.Verify(key); err != nil {
+		t.Error("Signed record should verify under its own key:", err)
+	}
+
+	if record.Verify(MutableKey(record.PublicKey, nil)) == nil {
+		t.Error("Record should not verify under a key with a different salt")
+	}
+
+	tampered := record
+	tampered.Value = []byte("goodbye")
+	if tampered.Verify(key) == nil {
+		t.Error("Record with a modified value should not verify")
+	}
+
+	tampered = record
+	tampered.Seq++
+	if tampered.Verify(key) == nil {
+		t.Error("Record with a modified sequence number should not verify")
+	}
+}
+
+func TestRecordSupersedes(t *testing.T) {
+	private := newTestKey(t)
+	first := NewMutableRecord(private, nil, 1, []byte("first"))
+	second := NewMutableRecord(private, nil, 2, []byte("second"))
+
+	if second.Supersedes(first) != nil {
+		t.Error("Higher sequence number should replace a stored record")
+	}
+	if first.Supersedes(second) == nil {
+		t.Error("Lower sequence number should not replace a stored record")
+	}
+	if first.Supersedes(first) == nil {
+		t.Error("Equal sequence number should not replace a stored record")
+	}
+	if NewValueRecord([]byte("squat")).Supersedes(first) == nil {
+		t.Error("Unsigned value should not replace a signed record")
+	}
+}
+
+func TestImmutableRecordVerify(t *testing.T) {
+	value := []byte("content")
+	record := NewImmutableRecord(value)
+
+	if err := record.Verify(ImmutableKey(value)); err != nil {
+		t.Error("Immutable record should verify under the hash of its value:", err)
+	}
+	if record.Verify(NewRandomNodeID()) == nil {
+		t.Error("Immutable record should not verify under any other key")
+	}
+}
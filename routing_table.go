@@ -1,73 +1,439 @@
 package kademlia
 
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type RoutingConfig struct {
+	// Buckets that do not cover our own ID may still split while their depth
+	// is not a multiple of RelaxedBits, keeping more contacts near us.  Values
+	// below 2 only ever split the bucket covering our own ID.
+	RelaxedBits int
+
+	// Routes on base 2^SymbolBits digits as in section 4.2 of the Kademlia
+	// paper: each level along our own ID is split up front into 2^b - 1
+	// buckets, one per differing digit.  Takes precedence over RelaxedBits.
+	SymbolBits int
+
+	// Limits on contacts sharing an IPv4 /24 or IPv6 /48, within a single
+	// bucket and across the whole table, zero disables a limit.  Contacts
+	// addressed by hostname all count as one subnet.
+	MaxSubnetPerBucket int
+	MaxSubnetPerTable  int
+
+	// Refuses newcomers from a subnet at its limit rather than letting them
+	// replace the least recently seen contact from that subnet
+	PreferLongLived bool
+
+	// Consecutive failures after which a contact is marked stale or removed,
+	// zero means StaleFailures and MaxFailures
+	StaleAfter  int
+	RemoveAfter int
+}
+
+/*
+ * RoutingTable
+ * Binary tree of k-buckets over the ID space, stored as its leaves ordered by
+ * prefix.  The table starts with a single bucket covering every ID, which
+ * splits as it fills up.
+ */
+
 type RoutingTable struct {
 	self     Contact
-	kbuckets [IDBytesLength]*KBucket
+	config   RoutingConfig
+	kbuckets []*KBucket
+	metrics  map[NodeID]*ContactMetrics
+	// Guarded by mutex, events are sent while it is held
+	subscriptions map[*Subscription]struct{}
+	mutex         sync.RWMutex
 }
 
-func (rt RoutingTable) Self() Contact {
+func (rt *RoutingTable) Self() Contact {
 	return rt.self
 }
 
 func NewRoutingTable(self Contact) *RoutingTable {
-	rt := &RoutingTable{
+	return NewRoutingTableWithConfig(self, RoutingConfig{})
+}
+
+func NewRoutingTableWithConfig(self Contact, config RoutingConfig) *RoutingTable {
+	return &RoutingTable{
 		self:     self,
-		kbuckets: [IDBytesLength]*KBucket{},
+		config:   config,
+		kbuckets: []*KBucket{NewKBucket()},
+		metrics:  make(map[NodeID]*ContactMetrics),
 	}
+}
+
+func (rt *RoutingTable) Update(contact Contact) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
 
-	for i := 0; i < IDBytesLength; i++ {
-		rt.kbuckets[i] = NewKBucket()
+	rt.update(contact, time.Now())
+}
+
+// Refreshes a contact that reached us.  Its addresses are only its own
+// claim, so those of a contact already in the table are kept.
+func (rt *RoutingTable) UpdateUnverified(contact Contact) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	if el := rt.kbuckets[rt.bucketIndex(contact.ID)].findById(contact.ID); el != nil {
+		contact = el.Value.(Contact)
 	}
+	rt.update(contact, time.Now())
+}
 
-	return rt
+func (rt *RoutingTable) update(contact Contact, seen time.Time) {
+	if contact.ID == rt.self.ID {
+		return
+	}
+
+	known := rt.contains(contact.ID)
+	subnet, limited := rt.limitedSubnet(contact)
+	if limited && known {
+		limited = false
+	}
+	if limited && rt.config.PreferLongLived && rt.atSubnetLimit(contact.ID, subnet) {
+		return
+	}
+
+	var replaced *Contact
+	for {
+		i := rt.bucketIndex(contact.ID)
+		bucket := rt.kbuckets[i]
+
+		if bucket.Update(contact) {
+			bucket.removeReplacement(contact.ID)
+			rt.seen(contact.ID, seen)
+
+			switch {
+			case replaced != nil:
+				rt.emit(Event{Kind: ContactReplaced, Contact: *replaced, Replacement: contact})
+			case known:
+				rt.emit(Event{Kind: ContactRefreshed, Contact: contact})
+			default:
+				rt.emit(Event{Kind: ContactAdded, Contact: contact})
+			}
+
+			if limited {
+				rt.enforceSubnetLimits(contact.ID, subnet)
+			}
+			return
+		}
+
+		if !rt.canSplit(bucket) {
+			// Stale contacts make way for newcomers, otherwise the newcomer
+			// waits for room in the replacement cache
+			if stale, ok := rt.staleContact(bucket); ok {
+				old, _ := rt.drop(stale)
+				replaced = &old
+				continue
+			}
+			bucket.addReplacement(SeenContact{contact, seen})
+			return
+		}
+		rt.split(i)
+	}
 }
 
-func (rt *RoutingTable) Update(contact Contact) {
-	prefixLength := contact.ID.PrefixLen(rt.self.ID)
-	if prefixLength == -1 {
+func (rt *RoutingTable) bucketIndex(id NodeID) int {
+	for i, bucket := range rt.kbuckets {
+		if bucket.covers(id) {
+			return i
+		}
+	}
+
+	panic("Routing table buckets do not cover the ID space")
+}
+
+func (rt *RoutingTable) canSplit(bucket *KBucket) bool {
+	if bucket.depth >= IDBytesLength {
+		return false
+	}
+
+	if bucket.covers(rt.self.ID) {
+		return true
+	}
+
+	if b := rt.config.SymbolBits; b > 1 {
+		return bucket.depth%b != 0
+	}
+
+	b := rt.config.RelaxedBits
+	return b > 1 && bucket.depth%b != 0
+}
+
+func (rt *RoutingTable) split(i int) {
+	bucket := rt.kbuckets[i]
+	zero, one := bucket.split()
+	rt.emit(Event{Kind: BucketSplit, Prefix: bucket.prefix, Depth: bucket.depth})
+
+	kbuckets := make([]*KBucket, 0, len(rt.kbuckets)+1)
+	kbuckets = append(kbuckets, rt.kbuckets[:i]...)
+	kbuckets = append(kbuckets, zero, one)
+	kbuckets = append(kbuckets, rt.kbuckets[i+1:]...)
+
+	rt.kbuckets = kbuckets
+
+	// Complete the digit so every symbol value has its own bucket
+	if b := rt.config.SymbolBits; b > 1 && zero.depth%b != 0 && zero.depth < IDBytesLength {
+		rt.split(i + 1)
+		rt.split(i)
+	}
+}
+
+// Snapshot of a bucket holding the IDs whose first Depth bits match Prefix
+type BucketInfo struct {
+	Prefix NodeID
+	Depth  int
+	// Least recently seen first
+	Contacts     Contacts
+	Replacements Contacts
+}
+
+// The lowest and highest IDs the bucket covers
+func (b BucketInfo) Range() (low, high NodeID) {
+	low, high = b.Prefix, b.Prefix
+	for i := b.Depth; i < IDBytesLength; i++ {
+		high.flipBit(i)
+	}
+
+	return
+}
+
+func (rt *RoutingTable) Buckets() []BucketInfo {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	buckets := make([]BucketInfo, 0, len(rt.kbuckets))
+	for _, bucket := range rt.kbuckets {
+		replacements := Contacts{}
+		for _, replacement := range bucket.replacements {
+			replacements = append(replacements, replacement.Contact)
+		}
+
+		buckets = append(buckets, BucketInfo{
+			Prefix:       bucket.prefix,
+			Depth:        bucket.depth,
+			Contacts:     bucket.appendContacts(Contacts{}),
+			Replacements: replacements,
+		})
+	}
+
+	return buckets
+}
+
+// Number of contacts in the table, excluding replacements
+func (rt *RoutingTable) Size() int {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	return len(rt.metrics)
+}
+
+func (rt *RoutingTable) Contains(id NodeID) bool {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	return rt.contains(id)
+}
+
+// Visits a snapshot of the contacts in the table until visit returns false,
+// visit may safely call back into the table
+func (rt *RoutingTable) ForEach(visit func(Contact) bool) {
+	for _, bucket := range rt.Buckets() {
+		for _, contact := range bucket.Contacts {
+			if !visit(contact) {
+				return
+			}
+		}
+	}
+}
+
+// Contacts in the table along with when they were last seen
+func (rt *RoutingTable) SeenContacts() []SeenContact {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	return rt.seenContacts()
+}
+
+func (rt *RoutingTable) seenContacts() []SeenContact {
+	seen := []SeenContact{}
+	for _, bucket := range rt.kbuckets {
+		for _, contact := range bucket.appendContacts(nil) {
+			seen = append(seen, SeenContact{contact, rt.metrics[contact.ID].LastSeen})
+		}
+	}
+
+	return seen
+}
+
+// Rebuilds the buckets under config in place, keeping contacts along with
+// their metrics and subscriptions.  Contacts the new limits leave no room for
+// are reported evicted.
+func (rt *RoutingTable) SetConfig(config RoutingConfig) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	seen := rt.seenContacts()
+	metrics := rt.metrics
+	subscriptions := rt.subscriptions
+
+	rt.config = config
+	rt.kbuckets = []*KBucket{NewKBucket()}
+	rt.metrics = make(map[NodeID]*ContactMetrics)
+	rt.subscriptions = nil
+	for _, contact := range seen {
+		rt.update(contact.Contact, contact.LastSeen)
+	}
+	for id, kept := range rt.metrics {
+		*kept = *metrics[id]
+	}
+
+	rt.subscriptions = subscriptions
+	for _, contact := range seen {
+		if !rt.contains(contact.ID) {
+			rt.emit(Event{Kind: ContactEvicted, Contact: contact.Contact})
+		}
+	}
+}
+
+// Removes a contact, and any cached replacement for it, filling its place
+// from the replacement cache
+func (rt *RoutingTable) Remove(id NodeID) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	rt.kbuckets[rt.bucketIndex(id)].removeReplacement(id)
+	rt.evict(id)
+}
+
+func (rt *RoutingTable) evict(id NodeID) {
+	old, ok := rt.drop(id)
+	if !ok {
 		return
 	}
 
-	bucket := rt.kbuckets[prefixLength]
-	bucket.Update(contact)
+	if promoted, ok := rt.promote(rt.kbuckets[rt.bucketIndex(id)]); ok {
+		rt.emit(Event{Kind: ContactReplaced, Contact: old, Replacement: promoted})
+	} else {
+		rt.emit(Event{Kind: ContactEvicted, Contact: old})
+	}
+}
+
+func (rt *RoutingTable) drop(id NodeID) (Contact, bool) {
+	bucket := rt.kbuckets[rt.bucketIndex(id)]
+	el := bucket.findById(id)
+	if el == nil {
+		return Contact{}, false
+	}
+
+	bucket.Remove(el)
+	delete(rt.metrics, id)
+	return el.Value.(Contact), true
+}
+
+// Moves the most recently seen replacement that fits the subnet limits into
+// the bucket
+func (rt *RoutingTable) promote(bucket *KBucket) (Contact, bool) {
+	for i := len(bucket.replacements) - 1; i >= 0; i-- {
+		candidate := bucket.replacements[i]
+		if subnet, ok := rt.limitedSubnet(candidate.Contact); ok &&
+			rt.atSubnetLimit(candidate.ID, subnet) {
+			continue
+		}
+
+		bucket.removeReplacement(candidate.ID)
+		bucket.PushBack(candidate.Contact)
+		rt.seen(candidate.ID, candidate.LastSeen)
+		return candidate.Contact, true
+	}
+
+	return Contact{}, false
+}
+
+// The least recently seen stale contact in bucket
+func (rt *RoutingTable) staleContact(bucket *KBucket) (NodeID, bool) {
+	for el := bucket.Front(); el != nil; el = el.Next() {
+		id := el.Value.(Contact).ID
+		if metrics, ok := rt.metrics[id]; ok && metrics.Stale {
+			return id, true
+		}
+	}
+
+	return NodeID{}, false
 }
 
+func (rt *RoutingTable) contains(id NodeID) bool {
+	return rt.kbuckets[rt.bucketIndex(id)].findById(id) != nil
+}
+
+// Gathers buckets nearest the target first and stops once no remaining
+// bucket can hold a contact in as close a distance class, so finer buckets
+// mean fewer contacts to consider.  The closest contacts are returned ranked,
+// live and low-latency ones first within each distance class.
 func (rt *RoutingTable) FindClosest(target NodeID, delta int) Contacts {
-	prefixLength := target.PrefixLen(rt.self.ID)
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	want := BucketSize
+	if delta < want {
+		want = delta
+	}
+	if want < 1 {
+		return Contacts{}
+	}
 
 	contacts := Contacts{}
-	if prefixLength == -1 {
+	if target == rt.self.ID {
 		contacts = append(contacts, rt.self)
-		prefixLength = IDBytesLength - 1
 	}
 
-	for i := prefixLength; i >= 0; i-- {
-		elt := rt.kbuckets[i].Front()
-		for elt != nil {
-			if len(contacts) < BucketSize {
-				contacts = append(contacts, elt.Value.(Contact))
-			} else {
-				return contacts
-			}
-			elt = elt.Next()
+	buckets := make([]*KBucket, len(rt.kbuckets))
+	copy(buckets, rt.kbuckets)
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].minDistance(target).Less(buckets[j].minDistance(target))
+	})
+
+	for i, bucket := range buckets {
+		contacts = bucket.appendContacts(contacts)
+		if contacts.Len() < want || i+1 == len(buckets) {
+			continue
 		}
-	}
 
-	for i := prefixLength + 1; i < IDBytesLength; i++ {
-		elt := rt.kbuckets[i].Front()
-		for elt != nil {
-			if len(contacts) < BucketSize {
-				contacts = append(contacts, elt.Value.(Contact))
-				elt = elt.Next()
-			} else {
-				return contacts
-			}
+		contacts.SortByDistance(target)
+		next := buckets[i+1].minDistance(target)
+		if contacts[want-1].ID.Xor(target).leadingZeros() > next.leadingZeros() {
+			break
 		}
 	}
 
-	if contacts.Len() > delta {
-		return contacts[:delta]
+	contacts.SortByDistance(target)
+	if contacts.Len() > want {
+		contacts = contacts[:want]
 	}
+	rt.rank(contacts, target)
 
 	return contacts
 }
+
+// A random ID sharing exactly the first i bits with our own
+func (rt *RoutingTable) randomIDInBucket(i int) NodeID {
+	id := NewRandomNodeID()
+	self := rt.self.ID
+
+	for bit := 0; bit < i; bit++ {
+		if id.bit(bit) != self.bit(bit) {
+			id.flipBit(bit)
+		}
+	}
+	if id.bit(i) == self.bit(i) {
+		id.flipBit(i)
+	}
+
+	return id
+}
@@ -1,6 +1,9 @@
 package kademlia
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestNewRoutingTable(t *testing.T) {
 	selfID := NewRandomNodeID()
@@ -11,10 +14,8 @@ func TestNewRoutingTable(t *testing.T) {
 		t.Error("Routing table self Contact not copied properly")
 	}
 
-	for i := 0; i < IDBytesLength; i++ {
-		if table.kbuckets[i].Len() != 0 {
-			t.Error("All buckets should have 0 length after initialization")
-		}
+	if len(table.kbuckets) != 1 || table.kbuckets[0].Len() != 0 {
+		t.Error("Routing table should start with a single empty bucket")
 	}
 }
 
@@ -39,3 +40,183 @@ func TestUpdate(t *testing.T) {
 		}
 	}
 }
+
+func TestUpdateReplacesAddresses(t *testing.T) {
+	table := NewRoutingTable(selfContact)
+	id := NewRandomNodeID()
+	table.Update(NewContact(id, "10.0.0.1:6000"))
+	table.RecordSuccess(id, time.Millisecond)
+
+	moved, _ := NewMultiContact(id, "10.0.0.2:6000", "[2001:db8::1]:6000")
+	table.Update(moved)
+	if closest := table.FindClosest(id, 1); closest[0] != moved {
+		t.Errorf("Expected %v in the table, got %v", moved, closest[0])
+	}
+	if metrics, _ := table.Metrics(id); metrics.Successes != 1 {
+		t.Error("Metrics should survive an address change")
+	}
+
+	// Addresses a contact merely claims do not replace known ones
+	table.UpdateUnverified(NewContact(id, "10.0.0.3:6000"))
+	if closest := table.FindClosest(id, 1); closest[0] != moved {
+		t.Errorf("Unverified addresses replaced %v with %v", moved, closest[0])
+	}
+}
+
+func fillRoutingTable(config RoutingConfig, count int) *RoutingTable {
+	table := NewRoutingTableWithConfig(selfContact, config)
+	for i := 0; i < count; i++ {
+		table.Update(NewContact(NewRandomNodeID(), "127.0.0.1:6000"))
+	}
+
+	return table
+}
+
+func checkBuckets(t *testing.T, table *RoutingTable) {
+	for _, bucket := range table.kbuckets {
+		if bucket.Len() > BucketSize {
+			t.Errorf("Bucket at depth %d holds %d contacts", bucket.depth, bucket.Len())
+		}
+		for _, contact := range bucket.appendContacts(nil) {
+			if !bucket.covers(contact.ID) {
+				t.Errorf("Bucket at depth %d holds %v outside its range", bucket.depth, contact.ID)
+			}
+		}
+	}
+}
+
+func TestUpdateSplitsOwnBucket(t *testing.T) {
+	table := fillRoutingTable(RoutingConfig{}, 500)
+	checkBuckets(t, table)
+
+	if len(table.kbuckets) < 2 {
+		t.Fatal("Full bucket covering self should have split")
+	}
+	if n := len(table.SeenContacts()); n <= BucketSize {
+		t.Errorf("Expected more than %d contacts after splitting, got %d", BucketSize, n)
+	}
+
+	// Only buckets on the path to our own ID split, so every bucket not
+	// covering self sits at a distinct depth
+	depths := map[int]bool{}
+	for _, bucket := range table.kbuckets {
+		if bucket.covers(selfID) {
+			continue
+		}
+		if depths[bucket.depth] {
+			t.Errorf("Bucket at depth %d split away from self", bucket.depth)
+		}
+		depths[bucket.depth] = true
+	}
+}
+
+func TestRelaxedSplitting(t *testing.T) {
+	standard := fillRoutingTable(RoutingConfig{}, 2000)
+	relaxed := fillRoutingTable(RoutingConfig{RelaxedBits: 3}, 2000)
+	checkBuckets(t, relaxed)
+
+	if len(relaxed.SeenContacts()) <= len(standard.SeenContacts()) {
+		t.Errorf("Relaxed table kept %d contacts, standard kept %d",
+			len(relaxed.SeenContacts()), len(standard.SeenContacts()))
+	}
+}
+
+func TestFindClosestAcrossBuckets(t *testing.T) {
+	table := fillRoutingTable(RoutingConfig{RelaxedBits: 2}, 300)
+	target := NewRandomNodeID()
+
+	all := Contacts{}
+	for _, seen := range table.SeenContacts() {
+		all = append(all, seen.Contact)
+	}
+	all.SortByDistance(target)
+
+	closest := table.FindClosest(target, BucketSize)
+	if closest.Len() != BucketSize {
+		t.Fatalf("Expected %d contacts, got %d", BucketSize, closest.Len())
+	}
+	for i, contact := range closest {
+		if contact != all[i] {
+			t.Fatalf("Contact %d is %v, expected %v", i, contact.ID, all[i].ID)
+		}
+	}
+}
+
+func TestSymbolRoutingBuckets(t *testing.T) {
+	const b = 3
+	table := fillRoutingTable(RoutingConfig{SymbolBits: b}, 1000)
+	checkBuckets(t, table)
+
+	// Every level along our own ID holds one bucket per digit value
+	levels := map[int]int{}
+	for _, bucket := range table.kbuckets {
+		if bucket.depth%b != 0 {
+			t.Errorf("Bucket at depth %d does not end on a digit", bucket.depth)
+		}
+		levels[bucket.depth]++
+	}
+
+	deepest := 0
+	for depth := range levels {
+		if depth > deepest {
+			deepest = depth
+		}
+	}
+	for depth := b; depth < deepest; depth += b {
+		if levels[depth] != 1<<b-1 {
+			t.Errorf("Level %d has %d buckets, expected %d", depth, levels[depth], 1<<b-1)
+		}
+	}
+	if levels[deepest] != 1<<b {
+		t.Errorf("Deepest level has %d buckets, expected %d", levels[deepest], 1<<b)
+	}
+}
+
+func TestInspection(t *testing.T) {
+	table := fillRoutingTable(RoutingConfig{}, 300)
+
+	buckets := table.Buckets()
+	if len(buckets) != len(table.kbuckets) {
+		t.Fatalf("Expected %d buckets, got %d", len(table.kbuckets), len(buckets))
+	}
+
+	size := 0
+	var next NodeID
+	for i, bucket := range buckets {
+		low, high := bucket.Range()
+		if low != next {
+			t.Errorf("Bucket %d starts at %v, expected %v", i, low, next)
+		}
+		next = high
+		next.increment()
+
+		for _, contact := range bucket.Contacts {
+			if contact.ID.Less(low) || high.Less(contact.ID) {
+				t.Errorf("Contact %v outside bucket %d", contact.ID, i)
+			}
+			if !table.Contains(contact.ID) {
+				t.Errorf("Contains(%v) should be true", contact.ID)
+			}
+		}
+		size += bucket.Contacts.Len()
+	}
+	if next != (NodeID{}) {
+		t.Error("Buckets should cover the whole ID space")
+	}
+
+	if table.Size() != size {
+		t.Errorf("Size() = %d, buckets hold %d", table.Size(), size)
+	}
+	if table.Contains(NewRandomNodeID()) {
+		t.Error("Contains should be false for unknown IDs")
+	}
+
+	visited := 0
+	table.ForEach(func(contact Contact) bool {
+		visited++
+		return visited < 5
+	})
+	if visited != 5 {
+		t.Errorf("ForEach should stop when visit returns false, visited %d", visited)
+	}
+}
@@ -1,60 +1,268 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/cfromknecht/kademlia"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func parseFlags() (port *int, firstContact *kademlia.Contact) {
-	port = flag.Int("port", 6000, "a int")
-	firstID := flag.String("first-id", "", "a hexideicimal node ID")
-	firstIP := flag.String("first-ip", "", "the TCP address of an existing node")
+const (
+	SAVE_INTERVAL = time.Minute
+)
+
+type config struct {
+	port         *int
+	firstContact *kademlia.Contact
+	difficulty   kademlia.Difficulty
+	useTLS       *bool
+	statePath    *string
+	seedDomain   *string
+	discover     *bool
+	loopback     *bool
+	krpcAddress  *string
+	bind         *string
+	advertise    *string
+}
+
+func parseFlags() (cfg config) {
+	cfg.port = flag.Int("port", 6000, "a int")
+	cfg.bind = flag.String("bind", "127.0.0.1", "comma separated IPs or interface names to listen on, :: for dual-stack on every interface")
+	cfg.advertise = flag.String("advertise", "", "comma separated IPs or hostnames peers should dial, the bound addresses if omitted")
+	cfg.useTLS = flag.Bool("tls", false, "encrypt and authenticate connections with TLS")
+	cfg.discover = flag.Bool("discover", false, "find peers on the local network via UDP multicast")
+	cfg.loopback = flag.Bool("discover-loopback", false, "discover peers on this host only, without multicast")
+	cfg.seedDomain = flag.String("seed-domain", "", "domain whose TXT records list seeds as id@host:port")
+	cfg.krpcAddress = flag.String("krpc", "", "UDP address to also speak BEP 5 KRPC on, e.g. 127.0.0.1:6881")
+	cfg.statePath = flag.String("state", "", "file to persist the node identity and routing table across restarts")
+	flag.IntVar(&cfg.difficulty.Static, "static-difficulty", 0, "leading zero bits required by the static crypto puzzle")
+	flag.IntVar(&cfg.difficulty.Dynamic, "dynamic-difficulty", 0, "leading zero bits required by the dynamic crypto puzzle")
+	firstID := flag.String("first-id", "", "a hexideicimal node ID, learned from the node if omitted")
+	firstIP := flag.String("first-ip", "", "comma separated TCP addresses of an existing node")
 
 	flag.Parse()
 
-	if *firstID == "" || *firstIP == "" {
-		firstID = nil
-		firstIP = nil
-	} else {
-		firstContact = &kademlia.Contact{}
-		*firstContact = kademlia.NewContact(kademlia.NewNodeID(*firstID), *firstIP)
+	if *firstIP != "" {
+		// A zero ID is learned by pinging the node when joining
+		id := kademlia.NodeID{}
+		if *firstID != "" {
+			var err error
+			id, err = kademlia.ParseNodeID(*firstID)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Invalid --first-id:", err)
+				os.Exit(2)
+			}
+		}
+
+		first, err := kademlia.NewMultiContact(id, splitList(*firstIP)...)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid --first-ip:", err)
+			os.Exit(2)
+		}
+		cfg.firstContact = &first
 	}
 
 	return
 }
 
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// Resolves interface names among hosts to their global unicast addresses
+func resolveHosts(hosts []string) ([]string, error) {
+	resolved := []string{}
+	for _, host := range hosts {
+		if net.ParseIP(host) != nil {
+			resolved = append(resolved, host)
+			continue
+		}
+
+		iface, err := net.InterfaceByName(host)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+				resolved = append(resolved, ipNet.IP.String())
+			}
+		}
+	}
+
+	return resolved, nil
+}
+
+// Listens on the bound hosts and advertises either them or the hosts given
+// by --advertise
+func selfAddresses(cfg config) (listen, advertise []string, err error) {
+	bind, err := resolveHosts(splitList(*cfg.bind))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(bind) == 0 {
+		return nil, nil, fmt.Errorf("No address to bind to in %q", *cfg.bind)
+	}
+
+	port := strconv.Itoa(*cfg.port)
+	for _, host := range bind {
+		listen = append(listen, net.JoinHostPort(host, port))
+	}
+
+	hosts := splitList(*cfg.advertise)
+	if len(hosts) == 0 {
+		hosts = bind
+	}
+	for _, host := range hosts {
+		advertise = append(advertise, net.JoinHostPort(host, port))
+	}
+
+	return listen, advertise, nil
+}
+
+// Reuses the persisted identity if there is one
+func loadState(cfg config) *kademlia.State {
+	if *cfg.statePath != "" {
+		state, err := kademlia.LoadState(*cfg.statePath)
+		if err == nil {
+			fmt.Println("Restored state from", *cfg.statePath)
+			return state
+		} else if !os.IsNotExist(err) {
+			panic(err)
+		}
+	}
+
+	identity, err := kademlia.NewIdentity(cfg.difficulty)
+	if err != nil {
+		panic(err)
+	}
+
+	return &kademlia.State{Identity: identity}
+}
+
+func saveState(cfg config, selfNetwork *kademlia.Kademlia) {
+	if *cfg.statePath == "" {
+		return
+	}
+
+	err := selfNetwork.SaveState(*cfg.statePath)
+	if err != nil {
+		fmt.Println("Save state error:", err)
+	}
+}
+
 func main() {
-	port, firstContact := parseFlags()
+	cfg := parseFlags()
 
-	if port == nil {
+	if cfg.port == nil {
 		panic("Must supply desired port number")
 	}
 
 	fmt.Println("Initializing Kademlia DHT ...")
 
-	selfID := kademlia.NewRandomNodeID()
+	state := loadState(cfg)
+	identity := state.Identity
+	selfID := identity.ID
+
+	listen, advertise, err := selfAddresses(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid --bind:", err)
+		os.Exit(2)
+	}
 
-	selfAddress := fmt.Sprintf("127.0.0.1:%d", *port)
-	self := kademlia.NewContact(selfID, selfAddress)
-	fmt.Println("Self:", selfID, selfAddress)
+	// Wildcard binds need an explicit --advertise
+	self, err := kademlia.NewMultiContact(selfID, advertise...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid self addresses, set --advertise:", err)
+		os.Exit(2)
+	}
+	fmt.Println("Self:", selfID, strings.Join(self.Addresses(), ", "))
 
 	selfNetwork := kademlia.NewKademlia(self, "Certcoin-DHT")
+	selfNetwork.Identity = identity
+	selfNetwork.Difficulty = cfg.difficulty
+	selfNetwork.ListenAddresses = listen
+
+	if *cfg.useTLS {
+		selfNetwork.Transport, err = kademlia.NewTLSTransport(identity)
+		if err != nil {
+			panic(err)
+		}
+	}
 
-	selfNetwork.Serve()
+	err = selfNetwork.Serve()
+	if err != nil {
+		panic(err)
+	}
 
-	if firstContact != nil {
-		contacts, err := selfNetwork.Bootstrap(*firstContact, self)
+	if len(state.Contacts) > 0 {
+		alive := selfNetwork.Restore(state.Contacts)
+		fmt.Printf("Restored %d of %d contacts\n", alive, len(state.Contacts))
+	}
+
+	if *cfg.discover || *cfg.loopback {
+		discovery, err := selfNetwork.StartDiscovery(kademlia.DiscoveryConfig{Loopback: *cfg.loopback})
 		if err != nil {
-			fmt.Println("Bootstrap error:", err)
+			fmt.Println("Discovery error:", err)
+		} else {
+			defer discovery.Close()
 		}
+	}
 
-		final := make(chan kademlia.Contacts)
-		selfNetwork.IterativeFindNode(firstContact.ID, kademlia.Delta, final)
-		contacts = <-final
-		fmt.Println("Iterative Find Node:", contacts)
+	if *cfg.krpcAddress != "" {
+		krpc, err := kademlia.ListenKRPC(selfID, *cfg.krpcAddress)
+		if err != nil {
+			fmt.Println("KRPC error:", err)
+		} else {
+			fmt.Println("Speaking KRPC on", krpc.Self().Address)
+			defer krpc.Close()
+		}
 	}
 
-	done := make(chan bool)
-	_ = <-done
+	selfNetwork.SeedDomain = *cfg.seedDomain
+
+	seeds := []kademlia.Contact{}
+	if cfg.firstContact != nil {
+		seeds = append(seeds, *cfg.firstContact)
+	}
+
+	if len(seeds) > 0 || selfNetwork.SeedDomain != "" {
+		err = selfNetwork.Join(context.Background(), seeds...)
+		if err != nil {
+			fmt.Println("Join error:", err)
+		} else {
+			fmt.Println("Joined network")
+		}
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	ticker := time.NewTicker(SAVE_INTERVAL)
+
+	for {
+		select {
+		case <-ticker.C:
+			saveState(cfg, selfNetwork)
+		case <-interrupt:
+			saveState(cfg, selfNetwork)
+			selfNetwork.Close()
+			return
+		}
+	}
 }
@@ -0,0 +1,63 @@
+package kademlia
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Looks up DNS TXT records, satisfied by *net.Resolver
+type SeedResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Reads seed contacts of the form id@host:port from the TXT records of name,
+// several seeds may share a record separated by whitespace
+func ResolveSeeds(ctx context.Context, resolver SeedResolver, name string) (Contacts,
+	error) {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	records, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	seeds := Contacts{}
+	for _, record := range records {
+		for _, field := range strings.Fields(record) {
+			seed, err := ParseSeed(field)
+			if err != nil {
+				continue
+			}
+			seeds = append(seeds, seed)
+		}
+	}
+
+	if seeds.Len() == 0 {
+		return nil, fmt.Errorf("No valid seeds in TXT records of %s", name)
+	}
+
+	return seeds, nil
+}
+
+func ParseSeed(seed string) (Contact, error) {
+	parts := strings.SplitN(seed, "@", 2)
+	if len(parts) != 2 {
+		return Contact{}, fmt.Errorf("Seed %q is not of the form id@host:port", seed)
+	}
+
+	id, err := ParseNodeID(parts[0])
+	if err != nil {
+		return Contact{}, err
+	}
+
+	err = ValidateAddress(parts[1])
+	if err != nil {
+		return Contact{}, err
+	}
+
+	return NewContact(id, parts[1]), nil
+}
@@ -0,0 +1,83 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, ok := r[name]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return records, nil
+}
+
+var parseSeedTests = []struct {
+	seed  string
+	valid bool
+}{
+	{"c06349c2f47c837f96d782f2753b2266d548bfa3@127.0.0.1:6000", true},
+	{"c06349c2f47c837f96d782f2753b2266d548bfa3@[::1]:6000", true},
+	{"c06349c2f47c837f96d782f2753b2266d548bfa3@seed.example.com:6000", true},
+	{"c06349c2f47c837f96d782f2753b2266d548bfa3@127.0.0.1", false},
+	{"c06349c2f47c837f96d782f2753b2266d548bfa3@127.0.0.1:99999", false},
+	{"c06349c2f47c837f96d782f2753b2266d548bfa3@:6000", false},
+	{"c06349c2f47c837f96d782f2753b2266d548bf@127.0.0.1:6000", false},
+	{"not-hex@127.0.0.1:6000", false},
+	{"127.0.0.1:6000", false},
+}
+
+func TestParseSeed(t *testing.T) {
+	for _, tt := range parseSeedTests {
+		_, err := ParseSeed(tt.seed)
+		if tt.valid && err != nil {
+			t.Errorf("Seed %q should parse: %s", tt.seed, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("Seed %q should be rejected", tt.seed)
+		}
+	}
+}
+
+func TestResolveSeeds(t *testing.T) {
+	resolver := fakeResolver{
+		"seeds.example.com": {
+			"c06349c2f47c837f96d782f2753b2266d548bfa3@127.0.0.1:6000 garbage",
+			"66472dba5cf4e1cbad155ad05beb14cb19d7c65a@127.0.0.1:6001",
+		},
+	}
+
+	seeds, err := ResolveSeeds(context.Background(), resolver, "seeds.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seeds.Len() != 2 || seeds[1].Address != "127.0.0.1:6001" {
+		t.Error("Expected both valid seeds to be resolved, got", seeds)
+	}
+
+	if _, err := ResolveSeeds(context.Background(), resolver, "missing.example.com"); err == nil {
+		t.Error("Resolving a missing domain should fail")
+	}
+}
+
+func TestJoinFromDNSSeeds(t *testing.T) {
+	seed := newTestNode(t)
+	joiner := newTestNode(t)
+	self := seed.routes.Self()
+
+	joiner.SeedDomain = "seeds.example.com"
+	joiner.SeedResolver = fakeResolver{
+		"seeds.example.com": {self.ID.String() + "@" + self.Address},
+	}
+
+	if err := joiner.Join(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if joiner.routes.FindClosest(self.ID, 1)[0] != self {
+		t.Error("Seed resolved from DNS should be in the routing table after joining")
+	}
+}
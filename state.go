@@ -0,0 +1,106 @@
+package kademlia
+
+import (
+	"encoding/gob"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type SeenContact struct {
+	Contact
+	LastSeen time.Time
+}
+
+// What a node needs to rejoin the network as itself after a restart
+type State struct {
+	Identity *Identity
+	Contacts []SeenContact
+}
+
+func (k *Kademlia) State() State {
+	return State{
+		Identity: k.Identity,
+		Contacts: k.routes.SeenContacts(),
+	}
+}
+
+func (k *Kademlia) SaveState(path string) error {
+	return SaveState(path, k.State())
+}
+
+// Writes state to a temporary file first so a crash never leaves a partially
+// written state behind
+func SaveState(path string, state State) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(file).Encode(state)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func LoadState(path string) (*State, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	state := &State{}
+	err = gob.NewDecoder(file).Decode(state)
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// Pings restored contacts, most recently seen first and Delta at a time, so
+// those likeliest to still be up claim room in the routing table first.  Only
+// those that respond make it into the routing table.  Returns how many did.
+func (k *Kademlia) Restore(contacts []SeenContact) int {
+	ordered := make([]SeenContact, len(contacts))
+	copy(ordered, contacts)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].LastSeen.After(ordered[j].LastSeen)
+	})
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	alive := 0
+	inFlight := make(chan struct{}, Delta)
+
+	for _, seen := range ordered {
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func(contact Contact) {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+
+			// Successful responses update the routing table
+			if k.Ping(contact) == nil {
+				mutex.Lock()
+				alive++
+				mutex.Unlock()
+			}
+		}(seen.Contact)
+	}
+
+	wg.Wait()
+
+	return alive
+}
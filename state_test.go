@@ -0,0 +1,129 @@
+package kademlia
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSaveAndLoadState(t *testing.T) {
+	kad := newTestKademlia()
+	kad.Identity = newTestIdentity(t)
+	contact := NewContact(NewRandomNodeID(), "127.0.0.1:6001")
+	kad.routes.Update(contact)
+
+	path := filepath.Join(t.TempDir(), "state")
+	if err := kad.SaveState(path); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state.Identity.ID != kad.Identity.ID ||
+		!state.Identity.PrivateKey.Equal(kad.Identity.PrivateKey) {
+		t.Error("Identity should survive a save and load")
+	}
+	if len(state.Contacts) != 1 || state.Contacts[0].Contact != contact {
+		t.Error("Routing table contacts should survive a save and load")
+	}
+	if state.Contacts[0].LastSeen.IsZero() {
+		t.Error("Last seen time should be persisted with each contact")
+	}
+}
+
+func TestRestorePingsContacts(t *testing.T) {
+	alive := newTestNode(t)
+	kad := newTestNode(t)
+	dead := NewContact(NewRandomNodeID(), "127.0.0.1:1")
+
+	restored := kad.Restore([]SeenContact{
+		{Contact: alive.routes.Self()},
+		{Contact: dead},
+	})
+
+	if restored != 1 {
+		t.Errorf("Expected 1 contact to respond, got %d", restored)
+	}
+	if kad.routes.FindClosest(dead.ID, 1)[0].ID == dead.ID {
+		t.Error("Unresponsive contacts should not be restored")
+	}
+	if kad.routes.FindClosest(alive.routes.Self().ID, 1)[0] != alive.routes.Self() {
+		t.Error("Responsive contacts should be restored")
+	}
+}
+
+// Records the contacts dialed, failing each dial once released
+type recordingTransport struct {
+	TCPTransport
+	release chan struct{}
+	mutex   sync.Mutex
+	dialed  []NodeID
+}
+
+func (r *recordingTransport) Dial(contact Contact) (net.Conn, error) {
+	r.mutex.Lock()
+	r.dialed = append(r.dialed, contact.ID)
+	r.mutex.Unlock()
+
+	<-r.release
+	return nil, errors.New("Unreachable")
+}
+
+func (r *recordingTransport) dials() []NodeID {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]NodeID{}, r.dialed...)
+}
+
+func TestRestorePingsMostRecentFirst(t *testing.T) {
+	transport := &recordingTransport{release: make(chan struct{})}
+	kad := newTestKademlia()
+	kad.Transport = transport
+
+	now := time.Now()
+	contacts := []SeenContact{}
+	for i := 0; i < 2*Delta; i++ {
+		contacts = append(contacts, SeenContact{
+			Contact:  NewContact(NewRandomNodeID(), "127.0.0.1:1"),
+			LastSeen: now.Add(time.Duration(i) * time.Minute),
+		})
+	}
+
+	done := make(chan int)
+	go func() {
+		done <- kad.Restore(contacts)
+	}()
+
+	// Only Delta pings are in flight at once
+	deadline := time.Now().Add(5 * time.Second)
+	for len(transport.dials()) < Delta && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	first := transport.dials()
+	close(transport.release)
+	<-done
+
+	if len(first) != Delta {
+		t.Fatalf("Expected %d pings in flight, got %d", Delta, len(first))
+	}
+	recent := make(map[NodeID]bool)
+	for _, seen := range contacts[Delta:] {
+		recent[seen.ID] = true
+	}
+	for _, id := range first {
+		if !recent[id] {
+			t.Error("Most recently seen contacts should be pinged first")
+		}
+	}
+	if dialed := len(transport.dials()); dialed != len(contacts) {
+		t.Errorf("Expected %d contacts pinged, got %d", len(contacts), dialed)
+	}
+}
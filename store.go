@@ -0,0 +1,301 @@
+package kademlia
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	db "github.com/syndtr/goleveldb/leveldb"
+	"time"
+)
+
+type StoreRequest struct {
+	RPCHeader
+	Key    NodeID
+	Record Record
+}
+
+func (k *Kademlia) NewStoreRequest(key NodeID, record Record) StoreRequest {
+	return StoreRequest{
+		RPCHeader: k.newRPCHeader(),
+		Key:       key,
+		Record:    record,
+	}
+}
+
+type StoreResponse struct {
+	RPCHeader
+}
+
+func (k *Kademlia) Store(contact Contact, key NodeID, record Record) error {
+	req := k.NewStoreRequest(key, record)
+	res := StoreResponse{}
+
+	return k.call(contact, "KademliaCore.StoreRPC", &req, &res)
+}
+
+func (kc *KademliaCore) StoreRPC(req StoreRequest, res *StoreResponse) error {
+	err := kc.handleRPC(req.RPCHeader, &res.RPCHeader)
+	if err != nil {
+		return err
+	}
+
+	err = kc.kad.requireCapability(CapRecords)
+	if err != nil {
+		return err
+	}
+
+	err = req.Record.Verify(req.Key)
+	if err != nil {
+		return err
+	}
+
+	return kc.kad.putRecord(req.Key, req.Record,
+		storeOwner{ID: req.Sender.ID, IP: kc.remoteIP})
+}
+
+// Stores record on the BucketSize nodes closest to key, returning how many
+// accepted it
+func (k *Kademlia) StoreRecord(key NodeID, record Record) (int, error) {
+	stored := 0
+	var lastErr error
+	for _, contact := range k.findCapable(key, CapRecords) {
+		err := k.Store(contact, key, record)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		stored++
+	}
+
+	if stored == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("No nodes available to store record")
+		}
+		return 0, lastErr
+	}
+
+	return stored, nil
+}
+
+func (k *Kademlia) PutMutable(private ed25519.PrivateKey, salt []byte, seq int64,
+	value []byte) (NodeID, error) {
+	record := NewMutableRecord(private, salt, seq, value)
+	key := MutableKey(record.PublicKey, salt)
+
+	_, err := k.StoreRecord(key, record)
+	return key, err
+}
+
+// Returns the valid record with the highest sequence number held by the nodes
+// closest to the key
+func (k *Kademlia) GetMutable(public ed25519.PublicKey, salt []byte) (*Record, error) {
+	var latest *Record
+	k.visitRecords(MutableKey(public, salt), func(record *Record) bool {
+		if record.Kind == MutableRecord && (latest == nil || record.Seq > latest.Seq) {
+			latest = record
+		}
+		return true
+	})
+
+	if latest == nil {
+		return nil, errors.New("Mutable record not found")
+	}
+
+	return latest, nil
+}
+
+func (k *Kademlia) PutImmutable(value []byte) (NodeID, error) {
+	key := ImmutableKey(value)
+
+	_, err := k.StoreRecord(key, NewImmutableRecord(value))
+	return key, err
+}
+
+func (k *Kademlia) GetImmutable(key NodeID) ([]byte, error) {
+	var value []byte
+	k.visitRecords(key, func(record *Record) bool {
+		// Responders choose the record kind, so check the content itself
+		if ImmutableKey(record.Value) != key {
+			return true
+		}
+		value = record.Value
+		return false
+	})
+
+	if value == nil {
+		return nil, errors.New("Immutable record not found")
+	}
+
+	return value, nil
+}
+
+// Queries the nodes closest to key for the record they hold, until visit
+// returns false
+func (k *Kademlia) visitRecords(key NodeID, visit func(*Record) bool) {
+	for _, contact := range k.findCapable(key, CapRecords) {
+		record, _, err := k.findRecord(contact, key)
+		if err != nil || record == nil {
+			continue
+		}
+		if !visit(record) {
+			return
+		}
+	}
+}
+
+/*
+ * Values database
+ */
+
+func valueKey(key NodeID) []byte {
+	return append([]byte("v"), key[:]...)
+}
+
+// Records are stored along with who stored them, for quota accounting
+type storedRecord struct {
+	Record Record
+	Owner  storeOwner
+}
+
+type storeOwner struct {
+	ID NodeID
+	IP string
+	// Stored by this node itself rather than on behalf of a peer
+	Local bool
+}
+
+var localOwner = storeOwner{Local: true}
+
+// Databases written before records held values as raw bytes under the bare
+// key, these become plain value records owned by this node
+func (k *Kademlia) migrateLegacyValues() error {
+	iter := k.valuesDB.NewIterator(nil, nil)
+	defer iter.Release()
+
+	batch := new(db.Batch)
+	for iter.Next() {
+		if len(iter.Key()) != len(NodeID{}) {
+			continue
+		}
+
+		var key NodeID
+		copy(key[:], iter.Key())
+		record := NewValueRecord(append([]byte{}, iter.Value()...))
+
+		var buffer bytes.Buffer
+		err := gob.NewEncoder(&buffer).Encode(storedRecord{record, localOwner})
+		if err != nil {
+			return err
+		}
+
+		batch.Put(valueKey(key), buffer.Bytes())
+		batch.Delete(key[:])
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	if batch.Len() == 0 {
+		return nil
+	}
+	return k.valuesDB.Write(batch, nil)
+}
+
+func (k *Kademlia) getRecord(key NodeID) (*Record, error) {
+	stored, _, err := k.getStoredRecord(key)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+
+	return &stored.Record, nil
+}
+
+func (k *Kademlia) getStoredRecord(key NodeID) (*storedRecord, int64, error) {
+	data, err := k.valuesDB.Get(valueKey(key), nil)
+	if err == db.ErrNotFound {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	stored, err := decodeStoredRecord(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return stored, int64(len(data)), nil
+}
+
+func decodeStoredRecord(data []byte) (*storedRecord, error) {
+	stored := &storedRecord{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+func (k *Kademlia) putRecord(key NodeID, record Record, owner storeOwner) error {
+	k.storeMutex.Lock()
+	defer k.storeMutex.Unlock()
+
+	limits := k.StoreLimits
+	if limits.MaxValueSize > 0 && len(record.Value) > limits.MaxValueSize {
+		return fmt.Errorf("%w: %d bytes exceeds %d", ErrValueTooLarge,
+			len(record.Value), limits.MaxValueSize)
+	}
+
+	existing, existingSize, err := k.getStoredRecord(key)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil {
+		err = record.Supersedes(existing.Record)
+		if err != nil {
+			return err
+		}
+	}
+
+	var buffer bytes.Buffer
+	err = gob.NewEncoder(&buffer).Encode(storedRecord{record, owner})
+	if err != nil {
+		return err
+	}
+
+	usage, err := k.storeUsage()
+	if err != nil {
+		return err
+	}
+
+	batch := new(db.Batch)
+	change := usage.change()
+	if existing != nil {
+		change.remove(newStoredEntry(valueKey(key), existing.Owner, existingSize,
+			time.Time{}))
+	}
+	change.add(newStoredEntry(valueKey(key), owner, int64(buffer.Len()), time.Time{}))
+
+	err = change.checkQuotas(owner, limits)
+	if err != nil {
+		return err
+	}
+
+	err = k.evictFor(key, change, limits, batch)
+	if err != nil {
+		return err
+	}
+
+	batch.Put(valueKey(key), buffer.Bytes())
+	err = k.valuesDB.Write(batch, nil)
+	if err != nil {
+		return err
+	}
+
+	usage.apply(change)
+
+	return nil
+}
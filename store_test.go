@@ -0,0 +1,163 @@
+package kademlia
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	db "github.com/syndtr/goleveldb/leveldb"
+	"net"
+	"testing"
+)
+
+func newTestNode(t *testing.T) *Kademlia {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	return newTestNodeAt(t, NewContact(NewRandomNodeID(), address))
+}
+
+// Serves a fresh node as self
+func newTestNodeAt(t *testing.T, self Contact) *Kademlia {
+	values, err := db.OpenFile(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kad := &Kademlia{
+		routes:       NewRoutingTable(self),
+		valuesDB:     values,
+		NetworkID:    "test",
+		Capabilities: DefaultCapabilities,
+	}
+	if err := kad.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { kad.Close() })
+
+	return kad
+}
+
+func TestStoreMutableRecord(t *testing.T) {
+	server := newTestNode(t)
+	client := newTestNode(t)
+	private := newTestKey(t)
+
+	first := NewMutableRecord(private, nil, 1, []byte("first"))
+	key := MutableKey(first.PublicKey, nil)
+	if err := client.Store(server.routes.Self(), key, first); err != nil {
+		t.Fatal("Storing a signed record should succeed:", err)
+	}
+
+	forged := first
+	forged.Seq = 2
+	forged.Value = []byte("forged")
+	if client.Store(server.routes.Self(), key, forged) == nil {
+		t.Error("Storing a record with an invalid signature should fail")
+	}
+
+	if client.Store(server.routes.Self(), key, first) == nil {
+		t.Error("Replaying a stored sequence number should fail")
+	}
+
+	second := NewMutableRecord(private, nil, 2, []byte("second"))
+	if err := client.Store(server.routes.Self(), key, second); err != nil {
+		t.Error("Storing a higher sequence number should succeed:", err)
+	}
+
+	record, _, err := client.findRecord(server.routes.Self(), key)
+	if err != nil || record == nil || !bytes.Equal(record.Value, second.Value) {
+		t.Error("Find value should return the latest signed record")
+	}
+}
+
+func TestGetMutable(t *testing.T) {
+	server := newTestNode(t)
+	client := newTestNode(t)
+	private := newTestKey(t)
+	client.routes.Update(server.routes.Self())
+
+	if _, err := client.PutMutable(private, []byte("salt"), 7, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := client.GetMutable(private.Public().(ed25519.PublicKey), []byte("salt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Seq != 7 || string(record.Value) != "value" {
+		t.Error("GetMutable should return the published record")
+	}
+}
+
+func TestStoreImmutableRecord(t *testing.T) {
+	server := newTestNode(t)
+	client := newTestNode(t)
+	value := []byte("content")
+	key := ImmutableKey(value)
+
+	forged := NewImmutableRecord([]byte("forged"))
+	if client.Store(server.routes.Self(), key, forged) == nil {
+		t.Error("Storing content that does not hash to its key should fail")
+	}
+
+	if err := client.Store(server.routes.Self(), key, NewImmutableRecord(value)); err != nil {
+		t.Error("Storing content under its hash should succeed:", err)
+	}
+}
+
+func TestGetImmutableRejectsForgedContent(t *testing.T) {
+	honest := newTestNode(t)
+	liar := newTestNode(t)
+	client := newTestNode(t)
+	client.routes.Update(liar.routes.Self())
+
+	value := []byte("content")
+	key := ImmutableKey(value)
+
+	// Plant forged bytes directly in the liar's store
+	if err := liar.putRecord(key, NewValueRecord([]byte("forged")), localOwner); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetImmutable(key); err == nil {
+		t.Error("Forged content should not be returned")
+	}
+
+	client.routes.Update(honest.routes.Self())
+	if err := honest.putRecord(key, NewImmutableRecord(value), localOwner); err != nil {
+		t.Fatal(err)
+	}
+	found, err := client.GetImmutable(key)
+	if err != nil || !bytes.Equal(found, value) {
+		t.Error("Verified content should be returned from an honest node")
+	}
+}
+
+func TestMigrateLegacyValues(t *testing.T) {
+	kad := newTestNode(t)
+	key := NewRandomNodeID()
+
+	// Raw value under the bare key, as stored before records
+	if err := kad.valuesDB.Put(key[:], []byte("legacy"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := kad.migrateLegacyValues(); err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := kad.getRecord(key)
+	if err != nil || record == nil || record.Kind != ValueRecord ||
+		string(record.Value) != "legacy" {
+		t.Errorf("Legacy value not migrated: %+v, %v", record, err)
+	}
+	if _, err := kad.valuesDB.Get(key[:], nil); err != db.ErrNotFound {
+		t.Error("Legacy entry should be removed once migrated")
+	}
+
+	usage, err := kad.storeUsage()
+	if err != nil || usage.total == 0 {
+		t.Errorf("Migrated value should count towards usage: %+v, %v", usage, err)
+	}
+}
@@ -0,0 +1,9 @@
+module github.com/cfromknecht/kademlia/testdata/libp2p/gen
+
+go 1.20
+
+require (
+	github.com/gogo/protobuf v1.3.2
+	github.com/libp2p/go-libp2p-kad-dht v0.25.2
+	github.com/libp2p/go-libp2p-record v0.2.0
+)
@@ -0,0 +1,149 @@
+// Writes the fixtures in testdata/libp2p with go-libp2p-kad-dht's generated
+// pb.Message, one length-prefixed message per file.  Run from this directory
+// with
+//
+//	go mod tidy && go run . ..
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht/pb"
+	rec "github.com/libp2p/go-libp2p-record/pb"
+)
+
+func id(b byte) []byte {
+	out := []byte{0x11, 0x14}
+	for i := 0; i < 20; i++ {
+		out = append(out, b)
+	}
+	return out
+}
+
+// ed25519 identity peer ID, as go-libp2p derives for ed25519 keys
+func ed25519Peer() []byte {
+	out := []byte{0x00, 0x24, 0x08, 0x01, 0x12, 0x20}
+	for i := 0; i < 32; i++ {
+		out = append(out, byte(i))
+	}
+	return out
+}
+
+func ip4tcp(a, b, c, d byte, port uint16) []byte {
+	out := []byte{0x04, a, b, c, d, 0x06}
+	return binary.BigEndian.AppendUint16(out, port)
+}
+
+func ip6tcp(ip [16]byte, port uint16) []byte {
+	out := append([]byte{0x29}, ip[:]...)
+	out = append(out, 0x06)
+	return binary.BigEndian.AppendUint16(out, port)
+}
+
+func write(dir, name string, msgs ...*dht.Message) {
+	var out []byte
+	for _, m := range msgs {
+		data, err := m.Marshal()
+		if err != nil {
+			panic(err)
+		}
+		out = binary.AppendUvarint(out, uint64(len(data)))
+		out = append(out, data...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), out, 0644); err != nil {
+		panic(err)
+	}
+}
+
+func peer(pid []byte, conn dht.Message_ConnectionType, addrs ...[]byte) dht.Message_Peer {
+	p := dht.Message_Peer{Addrs: addrs, Connection: conn}
+	p.Id.Unmarshal(pid)
+	return p
+}
+
+func main() {
+	dir := os.Args[1]
+	loopback6 := [16]byte{15: 1}
+
+	write(dir, "ping.bin", &dht.Message{Type: dht.Message_PING})
+
+	write(dir, "find_node_request.bin", &dht.Message{
+		Type: dht.Message_FIND_NODE,
+		Key:  id(0xaa),
+	})
+	write(dir, "find_node_response.bin", &dht.Message{
+		Type: dht.Message_FIND_NODE,
+		CloserPeers: []dht.Message_Peer{
+			peer(id(0x01), dht.Message_CONNECTED, ip4tcp(10, 0, 0, 1, 4001)),
+			peer(ed25519Peer(), dht.Message_CAN_CONNECT,
+				[]byte{0x36, 0x0b, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0x06, 0x0f, 0xa1},
+				ip6tcp(loopback6, 4002)),
+			peer(id(0x03), dht.Message_NOT_CONNECTED),
+		},
+	})
+
+	record := &rec.Record{Key: []byte("/v/greeting"), Value: []byte("hello libp2p")}
+	write(dir, "put_value_request.bin", &dht.Message{
+		Type:   dht.Message_PUT_VALUE,
+		Key:    []byte("/v/greeting"),
+		Record: record,
+	})
+	write(dir, "get_value_request.bin", &dht.Message{
+		Type: dht.Message_GET_VALUE,
+		Key:  []byte("/v/greeting"),
+	})
+	write(dir, "get_value_response.bin", &dht.Message{
+		Type:   dht.Message_GET_VALUE,
+		Key:    []byte("/v/greeting"),
+		Record: &rec.Record{Key: []byte("/v/greeting"), Value: []byte("hello libp2p")},
+		CloserPeers: []dht.Message_Peer{
+			peer(id(0x01), dht.Message_NOT_CONNECTED, ip4tcp(10, 0, 0, 1, 4001)),
+		},
+	})
+
+	// As a go-libp2p-kad-dht v0.25.2 node answers: NewMessage sets
+	// clusterLevelRaw to the request's level, always 0, plus one, and
+	// handlePutValue stamps stored records with the time they were received
+	write(dir, "kad_dht_get_value_response.bin", &dht.Message{
+		Type:            dht.Message_GET_VALUE,
+		Key:             []byte("/v/greeting"),
+		ClusterLevelRaw: 1,
+		Record: &rec.Record{
+			Key:          []byte("/v/greeting"),
+			Value:        []byte("hello libp2p"),
+			TimeReceived: "2024-03-01T12:00:00.123456789Z",
+		},
+		CloserPeers: []dht.Message_Peer{
+			peer(id(0x01), dht.Message_CONNECTED, ip4tcp(10, 0, 0, 1, 4001)),
+		},
+	})
+
+	// CIDv0-style sha2-256 multihash key
+	cid := []byte{0x12, 0x20}
+	for i := 0; i < 32; i++ {
+		cid = append(cid, byte(0xf0-i))
+	}
+	write(dir, "add_provider_request.bin", &dht.Message{
+		Type: dht.Message_ADD_PROVIDER,
+		Key:  cid,
+		ProviderPeers: []dht.Message_Peer{
+			peer(ed25519Peer(), dht.Message_NOT_CONNECTED, ip4tcp(192, 168, 1, 7, 4001)),
+		},
+	})
+	write(dir, "get_providers_request.bin", &dht.Message{
+		Type: dht.Message_GET_PROVIDERS,
+		Key:  cid,
+	})
+	write(dir, "get_providers_response.bin", &dht.Message{
+		Type: dht.Message_GET_PROVIDERS,
+		Key:  cid,
+		CloserPeers: []dht.Message_Peer{
+			peer(id(0x01), dht.Message_NOT_CONNECTED, ip4tcp(10, 0, 0, 1, 4001)),
+		},
+		ProviderPeers: []dht.Message_Peer{
+			peer(ed25519Peer(), dht.Message_NOT_CONNECTED, ip4tcp(192, 168, 1, 7, 4001)),
+		},
+	})
+}
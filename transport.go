@@ -0,0 +1,236 @@
+package kademlia
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+const (
+	DialTimeout = 5 * time.Second
+	// Head start each of a contact's addresses gets before the next is
+	// dialed, as recommended by RFC 8305
+	HappyEyeballsDelay = 250 * time.Millisecond
+)
+
+// Transport carries RPCs between contacts
+type Transport interface {
+	Dial(contact Contact) (net.Conn, error)
+	Listen(address string) (net.Listener, error)
+	// Authenticates an accepted connection, returning the remote's NodeID if
+	// the transport is able to prove it
+	RemoteID(conn net.Conn) (*NodeID, error)
+}
+
+// Dials addresses of contact in order, also dialing the next whenever the
+// previous fails or has not connected within HappyEyeballsDelay.  Returns the
+// first connection and the address it reached, closing any that follow.
+func dialHappyEyeballs(transport Transport, contact Contact,
+	addresses []string) (net.Conn, string, error) {
+	if len(addresses) == 0 {
+		return nil, "", fmt.Errorf("No address to dial for %s", contact.ID)
+	}
+
+	type attempt struct {
+		conn    net.Conn
+		address string
+		err     error
+	}
+	attempts := make(chan attempt, len(addresses))
+
+	next, pending := 0, 0
+	dialNext := func() {
+		address := addresses[next]
+		next++
+		pending++
+		go func() {
+			conn, err := transport.Dial(NewContact(contact.ID, address))
+			attempts <- attempt{conn, address, err}
+		}()
+	}
+
+	dialNext()
+	var lastErr error
+	for pending > 0 {
+		var delay <-chan time.Time
+		if next < len(addresses) {
+			delay = time.After(HappyEyeballsDelay)
+		}
+
+		select {
+		case a := <-attempts:
+			pending--
+			if a.err != nil {
+				lastErr = a.err
+				if next < len(addresses) {
+					dialNext()
+				}
+				continue
+			}
+
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					if late := <-attempts; late.err == nil {
+						late.conn.Close()
+					}
+				}
+			}(pending)
+			return a.conn, a.address, nil
+
+		case <-delay:
+			dialNext()
+		}
+	}
+
+	return nil, "", lastErr
+}
+
+/*
+ * TCPTransport
+ * Plaintext, unauthenticated transport
+ */
+
+type TCPTransport struct{}
+
+func (TCPTransport) Dial(contact Contact) (net.Conn, error) {
+	return net.DialTimeout("tcp", contact.Address, DialTimeout)
+}
+
+func (TCPTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+func (TCPTransport) RemoteID(conn net.Conn) (*NodeID, error) {
+	return nil, nil
+}
+
+/*
+ * TLSTransport
+ * Encrypts connections with TLS 1.3 using self-signed certificates for the
+ * node's ed25519 key, binding each channel to the NodeID derived from the
+ * remote's key
+ */
+
+type TLSTransport struct {
+	certificate tls.Certificate
+}
+
+func NewTLSTransport(identity *Identity) (*TLSTransport, error) {
+	if identity == nil {
+		return nil, errors.New("TLS transport requires a node identity")
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: identity.ID.String()},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth,
+		},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		identity.PublicKey, identity.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TLSTransport{
+		certificate: tls.Certificate{
+			Certificate: [][]byte{der},
+			PrivateKey:  identity.PrivateKey,
+		},
+	}, nil
+}
+
+func (t *TLSTransport) Dial(contact Contact) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: DialTimeout}
+	return tls.DialWithDialer(dialer, "tcp", contact.Address, t.config(&contact.ID))
+}
+
+func (t *TLSTransport) Listen(address string) (net.Listener, error) {
+	return tls.Listen("tcp", address, t.config(nil))
+}
+
+func (t *TLSTransport) RemoteID(conn net.Conn) (*NodeID, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, errors.New("Connection is not a TLS connection")
+	}
+
+	tlsConn.SetDeadline(time.Now().Add(DialTimeout))
+	defer tlsConn.SetDeadline(time.Time{})
+
+	err := tlsConn.Handshake()
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := certificateNodeID(tlsConn.ConnectionState().PeerCertificates[0].Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return &id, nil
+}
+
+// The remote proves possession of the certificate's key during the TLS 1.3
+// handshake, so only the key itself needs to be checked against the expected
+// NodeID.  An expected zero NodeID accepts any key, leaving callers to check
+// the ID RemoteID reports.
+func (t *TLSTransport) config(expected *NodeID) *tls.Config {
+	config := &tls.Config{
+		Certificates:       []tls.Certificate{t.certificate},
+		MinVersion:         tls.VersionTLS13,
+		InsecureSkipVerify: true,
+		ClientAuth:         tls.RequireAnyClientCert,
+	}
+
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("Remote did not present a certificate")
+		}
+
+		id, err := certificateNodeID(rawCerts[0])
+		if err != nil {
+			return err
+		}
+
+		if expected != nil && *expected != (NodeID{}) && id != *expected {
+			return fmt.Errorf("Expected remote Node ID %s, got %s", *expected, id)
+		}
+
+		return nil
+	}
+
+	return config
+}
+
+func certificateNodeID(raw []byte) (NodeID, error) {
+	certificate, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return NodeID{}, err
+	}
+
+	key, ok := certificate.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return NodeID{}, errors.New("Remote certificate does not carry an ed25519 key")
+	}
+
+	return NodeIDFromPublicKey(key), nil
+}
@@ -0,0 +1,235 @@
+package kademlia
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestIdentity(t *testing.T) *Identity {
+	identity, err := NewIdentity(Difficulty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+func newTestTLSTransport(t *testing.T, identity *Identity) *TLSTransport {
+	transport, err := NewTLSTransport(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transport
+}
+
+func TestTLSTransportBindsNodeID(t *testing.T) {
+	serverIdentity := newTestIdentity(t)
+	clientIdentity := newTestIdentity(t)
+	server := newTestTLSTransport(t, serverIdentity)
+	client := newTestTLSTransport(t, clientIdentity)
+
+	l, err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	remotes := make(chan *NodeID)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			remote, _ := server.RemoteID(conn)
+			remotes <- remote
+			conn.Close()
+		}
+	}()
+
+	conn, err := client.Dial(NewContact(serverIdentity.ID, l.Addr().String()))
+	if err != nil {
+		t.Fatal("Dialing the key holder should succeed:", err)
+	}
+	conn.Close()
+
+	remote := <-remotes
+	if remote == nil || *remote != clientIdentity.ID {
+		t.Error("Server should authenticate the client's Node ID")
+	}
+
+	conn, err = client.Dial(NewContact(NewRandomNodeID(), l.Addr().String()))
+	if err == nil {
+		conn.Close()
+		t.Error("Dialing a contact whose ID does not match the remote key should fail")
+	}
+	<-remotes
+}
+
+func TestHandleRPCRejectsUnauthenticatedSender(t *testing.T) {
+	remote := NewRandomNodeID()
+	core := &KademliaCore{kad: newTestKademlia(), remote: &remote}
+
+	req := RPCHeader{Sender: NewContact(NewRandomNodeID(), ""), NetworkID: "test"}
+	res := RPCHeader{}
+	if core.handleRPC(req, &res) == nil {
+		t.Error("Sender claiming an ID other than the authenticated one should be rejected")
+	}
+
+	req.Sender.ID = remote
+	if err := core.handleRPC(req, &res); err != nil {
+		t.Error("Sender claiming its authenticated ID should be accepted:", err)
+	}
+}
+
+// Responders must claim the ID their key proves, even when dialed by address
+func TestTLSResponderClaimingOtherID(t *testing.T) {
+	newTLSNode := func(identity *Identity, id NodeID) *Kademlia {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		address := l.Addr().String()
+		l.Close()
+
+		kad := &Kademlia{
+			routes:       NewRoutingTable(NewContact(id, address)),
+			NetworkID:    "test",
+			Transport:    newTestTLSTransport(t, identity),
+			Capabilities: DefaultCapabilities,
+		}
+		if err := kad.Serve(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { kad.Close() })
+
+		return kad
+	}
+
+	// The server holds key A but claims ID B
+	server := newTLSNode(newTestIdentity(t), NewRandomNodeID())
+	clientIdentity := newTestIdentity(t)
+	client := newTLSNode(clientIdentity, clientIdentity.ID)
+
+	address := server.routes.Self().Address
+	if _, err := client.Identify(address); err == nil {
+		t.Error("Responder claiming an ID other than its key's should be rejected")
+	}
+	if client.routes.Contains(server.routes.Self().ID) {
+		t.Error("Claimed ID should not be added to the routing table")
+	}
+	if !client.peers.isPenalized(address) {
+		t.Error("Address of the responder should be penalized")
+	}
+}
+
+// Connects to any address after its delay, or fails for addresses without one
+type delayedTransport struct {
+	TCPTransport
+	delays map[string]time.Duration
+	mutex  sync.Mutex
+	dialed []string
+}
+
+func (d *delayedTransport) Dial(contact Contact) (net.Conn, error) {
+	d.mutex.Lock()
+	d.dialed = append(d.dialed, contact.Address)
+	d.mutex.Unlock()
+
+	delay, ok := d.delays[contact.Address]
+	if !ok {
+		return nil, errors.New("Connection refused")
+	}
+	time.Sleep(delay)
+
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+var happyEyeballsTests = []struct {
+	delays  map[string]time.Duration
+	reached string
+}{
+	// A failed address moves straight on to the next
+	{map[string]time.Duration{"b:1": 0}, "b:1"},
+	// A slow address is overtaken by the next
+	{map[string]time.Duration{"a:1": time.Second, "b:1": 0}, "b:1"},
+	// Earlier addresses win when they connect within the delay
+	{map[string]time.Duration{"a:1": HappyEyeballsDelay / 5, "b:1": 0}, "a:1"},
+	{map[string]time.Duration{}, ""},
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	for _, tt := range happyEyeballsTests {
+		transport := &delayedTransport{delays: tt.delays}
+		contact := NewContact(NewRandomNodeID(), "a:1")
+
+		start := time.Now()
+		conn, reached, err := dialHappyEyeballs(transport, contact, []string{"a:1", "b:1", "c:1"})
+		if tt.reached == "" {
+			if err == nil {
+				t.Error("Dialing should fail when no address connects")
+			}
+			continue
+		}
+		if err != nil || reached != tt.reached {
+			t.Errorf("%v: expected to reach %s, got %s, %v", tt.delays, tt.reached, reached, err)
+			continue
+		}
+		conn.Close()
+
+		if elapsed := time.Since(start); elapsed > 2*HappyEyeballsDelay {
+			t.Errorf("%v: dialing took %s", tt.delays, elapsed)
+		}
+	}
+}
+
+// Nodes listen on every address and are reached through whichever answers
+func TestMultiAddressContact(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback unavailable:", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	self, err := NewMultiContact(NewRandomNodeID(),
+		net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+		net.JoinHostPort("::1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTestNodeAt(t, self)
+	client := newTestNode(t)
+
+	// The closed primary address is skipped
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+
+	dialed, _ := NewMultiContact(self.ID, dead, self.Address)
+	if err := client.Ping(dialed); err != nil {
+		t.Fatal("Ping should reach the second address:", err)
+	}
+
+	// Only addresses the server advertises are kept
+	expected, _ := NewMultiContact(self.ID, self.Address, self.Alternates[0])
+	client.routes.ForEach(func(contact Contact) bool {
+		if contact.ID == self.ID && contact != expected {
+			t.Errorf("Expected %v in the routing table, got %v", expected, contact)
+		}
+		return true
+	})
+
+	for _, address := range self.Addresses() {
+		if _, err := client.Identify(address); err != nil {
+			t.Errorf("Server should answer on %s: %s", address, err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package kademlia
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	PenaltyDuration = 10 * time.Minute
+)
+
+type rpcResponse interface {
+	header() *RPCHeader
+}
+
+func (h *RPCHeader) header() *RPCHeader {
+	return h
+}
+
+// Dials contact, invokes method and verifies the identity of the responder
+// before trusting anything it says about itself
+func (k *Kademlia) call(contact Contact, method string, req interface{},
+	res rpcResponse) error {
+	addresses := []string{}
+	for _, address := range contact.Addresses() {
+		if !k.peers.isPenalized(address) {
+			addresses = append(addresses, address)
+		}
+	}
+	if len(addresses) == 0 {
+		return fmt.Errorf("Contact %s is penalized", contact.Address)
+	}
+
+	start := time.Now()
+	client, reached, proven, err := k.dialContact(contact, addresses)
+	if err != nil {
+		k.routes.RecordFailure(contact.ID)
+		return err
+	}
+	defer client.Close()
+
+	err = client.Call(method, req, res)
+	if err != nil {
+		k.routes.RecordFailure(contact.ID)
+		return err
+	}
+	rtt := time.Since(start)
+
+	err = k.verifyResponder(contact.preferring(reached), proven, *res.header())
+	if err != nil {
+		return err
+	}
+
+	k.routes.RecordSuccess(res.header().Sender.ID, rtt)
+	return nil
+}
+
+// Responders must claim the ID we dialed or, when dialing by address alone,
+// the ID first seen at that address, the first of dialed's addresses.  Only
+// a peer contradicting the ID we verified at its address ourselves is
+// removed from the routing table and penalized.  The dialed ID may be a
+// third party's hint, so a mismatch against it only drops the hint.
+// Authenticated transports prove the remote's ID, which is nil otherwise, and
+// a responder claiming any other ID is penalized even when dialed by address
+// alone.
+func (k *Kademlia) verifyResponder(dialed Contact, proven *NodeID,
+	response RPCHeader) error {
+	sender := response.Sender
+
+	if proven != nil && sender.ID != *proven {
+		k.routes.Remove(*proven)
+		k.peers.penalize(dialed.Address)
+		return fmt.Errorf("%s authenticated as %s but claims %s", dialed.Address,
+			*proven, sender.ID)
+	}
+
+	recorded, known := k.peers.lookup(dialed.Address)
+	expected := dialed.ID
+	if expected == (NodeID{}) {
+		expected = recorded
+	}
+
+	if expected != (NodeID{}) && sender.ID != expected {
+		if known && sender.ID != recorded {
+			k.routes.Remove(recorded)
+			k.peers.penalize(dialed.Address)
+		}
+		return fmt.Errorf("Expected %s to respond as %s, got %s",
+			dialed.Address, expected, sender.ID)
+	}
+
+	err := checkProtocol(response)
+	if err != nil {
+		return err
+	}
+
+	err = VerifyPuzzle(sender.ID, response.PublicKey, response.Nonce, k.Difficulty)
+	if err != nil {
+		k.routes.Remove(sender.ID)
+		k.peers.penalize(dialed.Address)
+		return err
+	}
+
+	k.peers.record(dialed.Address, sender.ID)
+	// The address reached is known to be the responder's, other addresses
+	// only when it advertises them itself
+	addresses := []string{dialed.Address}
+	for _, address := range sender.Addresses() {
+		if address != dialed.Address && len(addresses) < MaxAddresses &&
+			ValidateAddress(address) == nil {
+			addresses = append(addresses, address)
+		}
+	}
+	reached := NewContact(sender.ID, addresses[0])
+	copy(reached.Alternates[:], addresses[1:])
+	k.routes.Update(reached)
+	k.routes.recordProtocol(response)
+
+	return nil
+}
+
+/*
+ * peerIdentities
+ * Tracks the ID first seen at each address and penalized addresses
+ */
+
+type peerIdentities struct {
+	mutex     sync.Mutex
+	ids       map[string]NodeID
+	penalties map[string]time.Time
+}
+
+func (p *peerIdentities) lookup(address string) (NodeID, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	id, ok := p.ids[address]
+	return id, ok
+}
+
+func (p *peerIdentities) record(address string, id NodeID) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.ids == nil {
+		p.ids = make(map[string]NodeID)
+	}
+	p.ids[address] = id
+}
+
+func (p *peerIdentities) penalize(address string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.penalties == nil {
+		p.penalties = make(map[string]time.Time)
+	}
+	p.penalties[address] = time.Now().Add(PenaltyDuration)
+	delete(p.ids, address)
+}
+
+func (p *peerIdentities) isPenalized(address string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	expiry, ok := p.penalties[address]
+	if ok && time.Now().After(expiry) {
+		delete(p.penalties, address)
+		return false
+	}
+
+	return ok
+}
@@ -0,0 +1,132 @@
+package kademlia
+
+import "testing"
+
+func newTestKademlia() *Kademlia {
+	self := NewContact(NewRandomNodeID(), "127.0.0.1:6000")
+	return &Kademlia{routes: NewRoutingTable(self), NetworkID: "test",
+		Capabilities: DefaultCapabilities}
+}
+
+func TestVerifyResponderAcceptsDialedID(t *testing.T) {
+	kad := newTestKademlia()
+	dialed := NewContact(NewRandomNodeID(), "127.0.0.1:6001")
+
+	err := kad.verifyResponder(dialed, nil, RPCHeader{Sender: dialed})
+	if err != nil {
+		t.Error("Responder claiming the dialed ID should be accepted:", err)
+	}
+	if kad.routes.FindClosest(dialed.ID, 1)[0] != dialed {
+		t.Error("Verified responder should be added to the routing table")
+	}
+}
+
+func TestVerifyResponderPenalizesChangedID(t *testing.T) {
+	kad := newTestKademlia()
+	dialed := NewContact(NewRandomNodeID(), "127.0.0.1:6001")
+	if err := kad.verifyResponder(dialed, nil, RPCHeader{Sender: dialed}); err != nil {
+		t.Fatal(err)
+	}
+
+	impostor := NewContact(NewRandomNodeID(), dialed.Address)
+	if kad.verifyResponder(dialed, nil, RPCHeader{Sender: impostor}) == nil {
+		t.Error("Responder claiming a different ID should be rejected")
+	}
+
+	for _, contact := range kad.routes.FindClosest(dialed.ID, BucketSize) {
+		if contact.ID == dialed.ID || contact.ID == impostor.ID {
+			t.Error("Peer whose identity changed should be dropped from the routing table")
+		}
+	}
+	if !kad.peers.isPenalized(dialed.Address) {
+		t.Error("Peer whose identity changed should be penalized")
+	}
+	if kad.Ping(dialed) == nil {
+		t.Error("Penalized peers should not be dialed")
+	}
+}
+
+func TestVerifyResponderFirstSeenID(t *testing.T) {
+	kad := newTestKademlia()
+	seed := NewContact(NodeID{}, "127.0.0.1:6001")
+	first := NewContact(NewRandomNodeID(), seed.Address)
+
+	if err := kad.verifyResponder(seed, nil, RPCHeader{Sender: first}); err != nil {
+		t.Error("First ID seen at an address should be accepted:", err)
+	}
+	if err := kad.verifyResponder(seed, nil, RPCHeader{Sender: first}); err != nil {
+		t.Error("Same ID seen again at an address should be accepted:", err)
+	}
+
+	second := NewContact(NewRandomNodeID(), seed.Address)
+	if kad.verifyResponder(seed, nil, RPCHeader{Sender: second}) == nil {
+		t.Error("Different ID at a previously seen address should be rejected")
+	}
+}
+
+// Lookups dial contacts other peers vouch for, a wrong hint must not cost the
+// honest node at that address its place
+func TestVerifyResponderIgnoresWrongHint(t *testing.T) {
+	kad := newTestKademlia()
+	honest := NewContact(NewRandomNodeID(), "127.0.0.1:6001")
+	if err := kad.verifyResponder(honest, nil, RPCHeader{Sender: honest}); err != nil {
+		t.Fatal(err)
+	}
+
+	hint := NewContact(NewRandomNodeID(), honest.Address)
+	if kad.verifyResponder(hint, nil, RPCHeader{Sender: honest}) == nil {
+		t.Error("Responder not claiming the hinted ID should be rejected")
+	}
+	if !kad.routes.Contains(honest.ID) {
+		t.Error("Honest node should stay in the routing table")
+	}
+	if kad.peers.isPenalized(honest.Address) {
+		t.Error("Honest node should not be penalized for a wrong hint")
+	}
+
+	// Nor when its address was never verified
+	fresh := NewContact(NewRandomNodeID(), "127.0.0.1:6002")
+	hint = NewContact(NewRandomNodeID(), fresh.Address)
+	if kad.verifyResponder(hint, nil, RPCHeader{Sender: fresh}) == nil {
+		t.Error("Responder not claiming the hinted ID should be rejected")
+	}
+	if kad.peers.isPenalized(fresh.Address) {
+		t.Error("Unverified address should not be penalized for a wrong hint")
+	}
+}
+
+func TestVerifyResponderRefreshesAddresses(t *testing.T) {
+	kad := newTestKademlia()
+	id := NewRandomNodeID()
+	stale, _ := NewMultiContact(id, "127.0.0.1:6001", "127.0.0.1:6002")
+	kad.routes.Update(stale)
+
+	// Reached at the first address, advertising a new alternate
+	advertised, _ := NewMultiContact(id, "127.0.0.1:6001", "127.0.0.1:6003")
+	if err := kad.verifyResponder(stale, nil, RPCHeader{Sender: advertised}); err != nil {
+		t.Fatal(err)
+	}
+	if closest := kad.routes.FindClosest(id, 1); closest[0] != advertised {
+		t.Errorf("Expected %v in the routing table, got %v", advertised, closest[0])
+	}
+}
+
+func TestVerifyResponderRequiresProvenID(t *testing.T) {
+	kad := newTestKademlia()
+	proven := NewRandomNodeID()
+	claimed := NewContact(NewRandomNodeID(), "127.0.0.1:6001")
+
+	dialed := NewContact(NodeID{}, claimed.Address)
+	if kad.verifyResponder(dialed, &proven, RPCHeader{Sender: claimed}) == nil {
+		t.Error("Responder claiming an ID other than the proven one should be rejected")
+	}
+	if kad.routes.Contains(claimed.ID) || !kad.peers.isPenalized(claimed.Address) {
+		t.Error("Responder contradicting its proven ID should be penalized")
+	}
+
+	honest := NewContact(proven, "127.0.0.1:6002")
+	if err := kad.verifyResponder(NewContact(NodeID{}, honest.Address), &proven,
+		RPCHeader{Sender: honest}); err != nil {
+		t.Error("Responder claiming its proven ID should be accepted:", err)
+	}
+}